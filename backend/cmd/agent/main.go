@@ -0,0 +1,114 @@
+// Агент CalcFlow: подключается к оркестратору и вычисляет выданные им операции.
+//
+// Настройки берутся по возрастанию приоритета: значения по умолчанию,
+// JSON файл (-config или AGENT_CONFIG), переменные окружения и флаги.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	agents "calc/backend/internal/agent"
+)
+
+func main() {
+	var flags agents.Config
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("AGENT_CONFIG"), "путь к JSON файлу с настройками агента")
+	fs.StringVar(&flags.OrchestratorAddr, "orchestrator", "", "адрес gRPC сервера оркестратора (ORCHESTRATOR_ADDR)")
+	fs.StringVar(&flags.Name, "name", "", "имя агента (AGENT_NAME)")
+	fs.StringVar(&flags.User, "user", "", "пользователь, которому принадлежит агент (AGENT_USER)")
+	fs.StringVar(&flags.UserToken, "user-token", "", "access токен пользователя для регистрации агента (AGENT_USER_TOKEN)")
+	fs.StringVar(&flags.StateFile, "state", "", "файл, в котором агент хранит свои ID и токен между запусками (AGENT_STATE)")
+	fs.StringVar(&flags.Org, "org", "", "организация, к общему пулу которой подключается агент (AGENT_ORG)")
+	fs.IntVar(&flags.Capacity, "capacity", 0, "число вычислителей (COMPUTING_POWER)")
+	fs.BoolVar(&flags.TLS, "tls", false, "подключаться к оркестратору по TLS (AGENT_TLS)")
+	fs.StringVar(&flags.TLSCAFile, "tls-ca", "", "сертификат CA для проверки оркестратора (AGENT_TLS_CA)")
+	fs.StringVar(&flags.TLSServerName, "tls-server-name", "", "имя сервера в сертификате оркестратора (AGENT_TLS_SERVER_NAME)")
+	fs.IntVar(&flags.Timings.Addition, "addition", 0, "время сложения в мс (TIME_ADDITION_MS)")
+	fs.IntVar(&flags.Timings.Subtraction, "subtraction", 0, "время вычитания в мс (TIME_SUBTRACTION_MS)")
+	fs.IntVar(&flags.Timings.Multiplication, "multiplication", 0, "время умножения в мс (TIME_MULTIPLICATIONS_MS)")
+	fs.IntVar(&flags.Timings.Division, "division", 0, "время деления в мс (TIME_DIVISIONS_MS)")
+	fs.IntVar(&flags.Timings.Exponent, "exponent", 0, "время возведения в степень в мс (TIME_EXPONENT_MS)")
+	functions := fs.String("functions", "", "время функций в мс, например sqrt=100,sin=300 (TIME_FUNCTIONS_MS)")
+	operators := fs.String("operators", "", "время операторов % // < <= > >= == != && || ! ?: в мс, например %=100,<==50 (TIME_OPERATORS_MS)")
+	costOverrides := fs.String("cost-overrides", "", "время операций в мс, которое агент использует вместо присланного оркестратором, например +=10,sqrt=0 (COST_OVERRIDES_MS)")
+	fs.BoolVar(&flags.ZeroCost, "zero-cost", false, "выполнять операции без задержки (AGENT_ZERO_COST)")
+	fs.Parse(os.Args[1:])
+
+	cfg := agents.DefaultConfig()
+	if *configPath != "" {
+		if err := cfg.LoadConfigFile(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Флаги важнее всего остального, но только те, что заданы явно
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "orchestrator":
+			cfg.OrchestratorAddr = flags.OrchestratorAddr
+		case "name":
+			cfg.Name = flags.Name
+		case "user":
+			cfg.User = flags.User
+		case "user-token":
+			cfg.UserToken = flags.UserToken
+		case "state":
+			cfg.StateFile = flags.StateFile
+		case "org":
+			cfg.Org = flags.Org
+		case "capacity":
+			cfg.Capacity = flags.Capacity
+		case "tls":
+			cfg.TLS = flags.TLS
+		case "tls-ca":
+			cfg.TLSCAFile = flags.TLSCAFile
+		case "tls-server-name":
+			cfg.TLSServerName = flags.TLSServerName
+		case "addition":
+			cfg.Timings.Addition = flags.Timings.Addition
+		case "subtraction":
+			cfg.Timings.Subtraction = flags.Timings.Subtraction
+		case "multiplication":
+			cfg.Timings.Multiplication = flags.Timings.Multiplication
+		case "division":
+			cfg.Timings.Division = flags.Timings.Division
+		case "exponent":
+			cfg.Timings.Exponent = flags.Timings.Exponent
+		case "zero-cost":
+			cfg.ZeroCost = flags.ZeroCost
+		}
+	})
+	if *functions != "" {
+		timings, err := agents.ParseFunctionTimings(*functions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Timings.SetFunctions(timings)
+	}
+	if *operators != "" {
+		timings, err := agents.ParseOperatorTimings(*operators)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Timings.SetOperators(timings)
+	}
+	if *costOverrides != "" {
+		costs, err := agents.ParseCostOverrides(*costOverrides)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.SetCostOverrides(costs)
+	}
+
+	if err := agents.Run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "agent:", err)
+		os.Exit(1)
+	}
+}
@@ -2,458 +2,159 @@ package agent
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"log"
-	"math"
-	"net"
 	"strconv"
 	"time"
-	"unicode"
 
+	"calc/backend/internal/expr"
 	agentrpc "calc/backend/internal/proto/calc_agent"
 	orchest "calc/backend/internal/proto/orchest"
-
-	_ "github.com/mattn/go-sqlite3"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
-type agentServer struct {
-	// Встраиваем пустую реализацию UnimplementedAgentServer
-	agentrpc.UnimplementedAgentServer
-	id int
-}
+// Сколько агент ждёт ответа оркестратора на регистрацию
+const registerTimeout = 10 * time.Second
 
-// Реализация метода CalculateExpression
-func (s agentServer) CalculateExpression(ctx context.Context, req *agentrpc.ExpressionRequest) (*agentrpc.Result, error) {
-	// Получаем значения выражения и времени выполнения операций из объекта req
+// CalculateExpression вычисляет операцию, полученную от оркестратора.
+// Время операций, которое оркестратор не прислал, берётся из настроек агента cfg,
+// а время, переопределённое агентом, важнее присланного.
+// Если ctx отменён, вычисление прерывается и возвращается ошибка контекста.
+func CalculateExpression(ctx context.Context, req *agentrpc.ExpressionRequest, cfg Config) (*agentrpc.Result, error) {
 	expression := req.GetExpression()
-	addition := req.GetAddition()
-	subtraction := req.GetSubtraction()
-	multiplication := req.GetMultiplication()
-	division := req.GetDivision()
-	exponent := req.GetExponent()
-
-	// Проверяем операнды на пустоту и устанавливаем значения по умолчанию, если они пусты
-	if addition == 0 {
-		addition = 200 // Устанавливаем значение по умолчанию для сложения
-	}
-	if subtraction == 0 {
-		subtraction = 200 // Устанавливаем значение по умолчанию для вычитания
-	}
-	if multiplication == 0 {
-		multiplication = 200 // Устанавливаем значение по умолчанию для умножения
-	}
-	if division == 0 {
-		division = 200 // Устанавливаем значение по умолчанию для деления
-	}
-	if exponent == 0 {
-		exponent = 200 // Устанавливаем значение по умолчанию для возведения в степень
+	// Присланное время операции важнее времени агента по умолчанию, даже если оно нулевое
+	costs := make(map[string]int, len(req.GetCosts()))
+	for op, ms := range req.GetCosts() {
+		costs[op] = int(ms)
 	}
+	requested := Overrides{Base: cfg.Timings, Costs: costs}
 
-	// Вызываем функцию для вычисления выражения с полученными значениями времени выполнения операций
-	result, err := evaluateExpression(expression, fmt.Sprint(s.id), int(addition), int(subtraction), int(multiplication), int(division), int(exponent))
+	numeric, err := expr.NewNumeric(req.GetMode(), uint(req.GetPrecision()))
 	if err != nil {
 		return nil, err
 	}
 
-	// Создаем и возвращаем объект pb.ExpressionResponse с результатом вычисления
-	return &agentrpc.Result{Result: fmt.Sprint(int(result))}, nil
-}
-
-var db *sql.DB
-
-type Agent struct {
-	ID     int
-	Port   int
-	Status string
-	User   string
-}
-
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "expressions.db")
+	// Вызываем функцию для вычисления выражения с полученными значениями времени выполнения операций.
+	// Результат передаётся точной строкой без экспоненты, чтобы оркестратор
+	// мог подставить его в следующую операцию без потери точности
+	funcs, err := expr.ParseDefinitions(req.GetDefinitions())
 	if err != nil {
-		log.Fatal("Error opening database:", err)
-	}
-}
-
-func updateAgentStatus(agentID, status string) error {
-	// Начинаем транзакцию
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
-		return err
+		return nil, err
 	}
-	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+	env := expr.Env{Vars: req.GetVariables(), Funcs: funcs}
 
-	// Выполняем запрос обновления в рамках транзакции
-	_, err = tx.Exec("UPDATE agents SET status = ?, last_ping = ? WHERE id = ?", status, time.Now(), agentID)
+	result, err := evaluateExpression(ctx, expression, numeric, env, cfg.costModel(requested))
 	if err != nil {
-		return err
-	}
-
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		return err
+		return nil, err
 	}
-
-	return nil
+	return &agentrpc.Result{Result: result}, nil
 }
 
-func getAgentsFromDB() ([]Agent, error) {
-	tx, err := db.Begin()
+// register получает у оркестратора ID агента и токен, которым агент подтверждает этот ID.
+// Право зарегистрировать агента подтверждает access токен пользователя. Агент с именем получает прежний ID, безымянный — ID мёртвого безымянного агента пользователя или новый.
+func register(cfg Config) (int, string, error) {
+	conn, err := dial(cfg, agentCredentials{token: cfg.UserToken, secure: cfg.TLS})
 	if err != nil {
-		return nil, fmt.Errorf("error opening database: %v", err)
+		return 0, "", err
 	}
+	defer conn.Close()
 
-	rows, err := tx.Query("SELECT id, port, status, user FROM agents")
+	ctx, cancel := context.WithTimeout(context.Background(), registerTimeout)
+	defer cancel()
+	resp, err := orchest.NewOrchestratorClient(conn).Register(ctx, &orchest.RegisterRequest{User: cfg.User, Name: cfg.Name, Org: cfg.Org})
 	if err != nil {
-		return nil, fmt.Errorf("error querying agents: %v", err)
-	}
-	defer rows.Close()
-
-	var agents []Agent
-	for rows.Next() {
-		var agent Agent
-		if err := rows.Scan(&agent.ID, &agent.Port, &agent.Status, &agent.User); err != nil {
-			return nil, fmt.Errorf("error scanning agent row: %v", err)
-		}
-		agents = append(agents, agent)
+		return 0, "", fmt.Errorf("ошибка регистрации агента: %v", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over agent rows: %v", err)
-	}
-
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		return nil, err
-	}
-
-	return agents, nil
-}
 
-func StartAgent(user string) {
-	initDB()
-	defer db.Close()
-	agents, err := getAgentsFromDB()
+	id, err := strconv.Atoi(resp.GetAgentId())
 	if err != nil {
-		log.Fatalf("Error getting agents from database: %v", err)
-	}
-	// Перебираем список агентов
-	for _, agent := range agents {
-		// Проверяем статус агента
-		if agent.Status == "dead" && agent.User == user {
-			// Создание TCP соединения на указанном порту
-			lis, err := net.Listen("tcp", fmt.Sprintf(":%d", agent.Port))
-			if err != nil {
-				log.Fatalf("failed to listen: %v", err)
-			}
-			// Создание нового сервера gRPC
-			grpcServer := grpc.NewServer()
-			server := agentServer{agentrpc.UnimplementedAgentServer{}, agent.ID}
-			// Регистрация вашего сервера сгенерированным кодом gRPC
-			agentrpc.RegisterAgentServer(grpcServer, server)
-			// Если агент мертв, запускаем его сервер
-			log.Print("starting agent...")
-			orchestratorURL := "localhost:8079"
-			// Функция для отправки пинга оркестратору
-			go sendPing(orchestratorURL, fmt.Sprint(agent.ID), agent.User)
-			// Запуск сервера
-			if err := grpcServer.Serve(lis); err != nil {
-				log.Fatalf("failed to serve: %v", err)
-			}
-		}
-	}
-
-	// Создаем нового агента и запускаем его сервер
-	if len(agents) > 0 {
-		initDB()
-		defer db.Close()
-		newAgentPort := agents[len(agents)-1].Port + 1
-		newAgentID := agents[len(agents)-1].ID + 1
-		// Создание TCP соединения на указанном порту
-		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", newAgentPort))
-		if err != nil {
-			log.Fatalf("failed to listen: %v", err)
-		}
-		// Создание нового сервера gRPC
-		grpcServer := grpc.NewServer()
-		server := agentServer{agentrpc.UnimplementedAgentServer{}, newAgentID}
-		// Регистрация вашего сервера сгенерированным кодом gRPC
-		agentrpc.RegisterAgentServer(grpcServer, server)
-		// Если агент мертв, запускаем его сервер
-		log.Print("starting agent...")
-		orchestratorURL := "localhost:8079"
-		// Функция для отправки пинга оркестратору
-		go sendPing(orchestratorURL, fmt.Sprint(newAgentID), user)
-		// Сохраняем агента в БД
-		updateAgentsDB(newAgentID, newAgentPort, user)
-		// Запуск сервера
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("failed to serve: %v", err)
-		}
-	} else {
-		initDB()
-		defer db.Close()
-		// Обработка случая, когда список агентов пустой
-		newAgentPort := 8081
-		newAgentID := 1
-		// Создание TCP соединения на указанном порту
-		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", newAgentPort))
-		if err != nil {
-			log.Fatalf("failed to listen: %v", err)
-		}
-		// Создание нового сервера gRPC
-		grpcServer := grpc.NewServer()
-		server := agentServer{agentrpc.UnimplementedAgentServer{}, newAgentID}
-		// Регистрация вашего сервера сгенерированным кодом gRPC
-		agentrpc.RegisterAgentServer(grpcServer, server)
-		// Если агент мертв, запускаем его сервер
-		log.Print("starting agent...")
-		orchestratorURL := "localhost:8079"
-		// Функция для отправки пинга оркестратору
-		go sendPing(orchestratorURL, fmt.Sprint(newAgentID), user)
-		// Сохраняем агента в БД
-		updateAgentsDB(newAgentID, newAgentPort, user)
-		// Запуск сервера
-		if err := grpcServer.Serve(lis); err != nil {
-			log.Fatalf("failed to serve: %v", err)
-		}
+		return 0, "", fmt.Errorf("оркестратор вернул неверный ID агента %q", resp.GetAgentId())
 	}
+	return id, resp.GetToken(), nil
 }
 
-func updateAgentsDB(id, port int, user string) error {
-	tx, err := db.Begin()
-	if err != nil {
+// StartAgent запускает агента пользователя внутри процесса оркестратора.
+// userToken — access токен пользователя для регистрации агента, org — организация, к пулу которой
+// подключается агент, пустая — личный агент. Регистрация выполняется сразу, а работа агента продолжается в фоне.
+func StartAgent(user, userToken, org string) error {
+	cfg := DefaultConfig()
+	if err := cfg.ApplyEnv(); err != nil {
 		return err
 	}
-	// Если запись с указанным ID не существует, вставляем новую запись
-	_, err = tx.Exec("INSERT INTO agents (id, port, status, user) VALUES (?, ?, ?, ?)", id, port, "alive", user)
-	if err != nil {
+	cfg.User = user
+	cfg.UserToken = userToken
+	cfg.Org = org
+	cfg.Name = ""
+	cfg.StateFile = ""
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
-	fmt.Printf("Inserted new agent: ID=%d, Port=%d\n", id, port)
 
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
+	id, token, err := register(cfg)
+	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func sendPing(orchestURL, agentID, user string) {
-	// Создаем таймер для повторения операции каждые 7 секунд
-	ticker := time.NewTicker(7 * time.Second)
-	defer ticker.Stop()
-
-	// Бесконечный цикл для отправки пингов
-	for range ticker.C {
-		// Вызываем функцию отправки пинга
-		err := sendPingOnce(orchestURL, agentID, user)
-		if err != nil {
-			// Обработка ошибки, если таковая имеется
-			// Например, логирование или другие действия
-			log.Printf("Ошибка при отправке пинга: %v", err)
+	go func() {
+		if err := serve(cfg, id, token); err != nil {
+			log.Printf("Агент %d остановлен: %v", id, err)
 		}
-	}
-}
-
-// sendPingOnce отправляет один раз пинг оркестратору от агента
-func sendPingOnce(orchestURL, agentID, user string) error {
-	// Создаем клиент gRPC с небезопасными учетными данными
-	creds := insecure.NewCredentials()
-	// Создаем клиент gRPC
-	conn, err := grpc.Dial(orchestURL, grpc.WithTransportCredentials(creds))
-	if err != nil {
-		return fmt.Errorf("ошибка при наборе соединения с оркестратором: %v", err)
-	}
-	defer conn.Close()
-	client := orchest.NewOrchestratorClient(conn)
-
-	// Создаем объект PingRequest с ID агента
-	req := &orchest.PingRequest{
-		AgentId: agentID,
-		User:    user,
-	}
-
-	// Вызываем метод Ping на оркестраторе
-	_, err = client.Ping(context.Background(), req)
-	if err != nil {
-		return fmt.Errorf("ошибка при вызове метода Ping на оркестраторе: %v", err)
-	}
-
+	}()
 	return nil
 }
 
-// HandleExpression принимает выражение от оркестратора, вычисляет его и отправляет результат обратно.
-func HandleExpression(id int, req *agentrpc.ExpressionRequest) (*agentrpc.Result, error) {
-	// Создаем клиент gRPC с небезопасными учетными данными
-	creds := insecure.NewCredentials()
-	// Создаем клиент gRPC
-	conn, err := grpc.Dial("localhost:8080", grpc.WithTransportCredentials(creds))
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
+// Run регистрирует агента и держит сессию с оркестратором до завершения процесса.
+// Агент только обращается к оркестратору сам, поэтому ему не нужен открытый порт.
+func Run(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	defer conn.Close()
-	client := agentrpc.NewAgentClient(conn)
 
-	// Вызываем метод Calculate вашего gRPC сервиса
-	response, err := client.CalculateExpression(context.Background(), req)
+	id, token, err := registration(cfg)
 	if err != nil {
-		log.Print("ошибка при вызове gRPC сервиса")
-		return nil, err
+		return err
 	}
-
-	return response, nil
-}
-
-func evaluateExpression(expression, id string, op1, op2, op3, op4, op5 int) (float64, error) {
-	updateAgentStatus(id, "busy")
-	tokens := tokenize(expression)
-	postfix := infixToPostfix(tokens)
-	result, err := evaluatePostfix(postfix)
-	//Cчитаем время
-	total := Time(expression, op1, op2, op3, op4, op5)
-	time.Sleep(time.Duration(total) * time.Millisecond)
-	updateAgentStatus(id, "alive")
-	return result, err
+	return serve(cfg, id, token)
 }
 
-func Time(expr string, op1, op2, op3, op4, op5 int) int {
-	totaltime := 0
-	for _, token := range expr {
-		switch {
-		case token == '+':
-			totaltime += op1
-		case token == '-':
-			totaltime += op2
-		case token == '*':
-			totaltime += op3
-		case token == '/':
-			totaltime += op4
-		case token == '^':
-			totaltime += op5
+// registration возвращает ID и токен агента: сохранённые в cfg.StateFile или, если их там нет,
+// полученные при регистрации по токену пользователя. Новая регистрация сохраняется в файл.
+func registration(cfg Config) (int, string, error) {
+	if cfg.StateFile != "" {
+		state, ok, err := loadState(cfg.StateFile)
+		if err != nil {
+			return 0, "", err
 		}
-	}
-	return totaltime
-}
-
-func tokenize(expression string) []string {
-	var tokens []string
-	var current string
-	for _, char := range expression {
-		if unicode.IsDigit(char) || char == '.' {
-			current += string(char)
-		} else if char == '+' || char == '-' || char == '*' || char == '/' || char == '(' || char == ')' || char == '^' {
-			if current != "" {
-				tokens = append(tokens, current)
-				current = ""
-			}
-			tokens = append(tokens, string(char))
+		if ok {
+			log.Printf("Агент %d подключается с сохранённым токеном из %s", state.AgentID, cfg.StateFile)
+			return state.AgentID, state.Token, nil
 		}
 	}
-	if current != "" {
-		tokens = append(tokens, current)
+	if cfg.UserToken == "" {
+		return 0, "", fmt.Errorf("агент ещё не зарегистрирован: не задан токен пользователя")
 	}
-	return tokens
-}
 
-func infixToPostfix(infix []string) []string {
-	var postfix []string
-	var operators []string
-	for _, token := range infix {
-		if isNumber(token) {
-			postfix = append(postfix, token)
-		} else if token == "(" {
-			operators = append(operators, token)
-		} else if token == ")" {
-			for len(operators) > 0 && operators[len(operators)-1] != "(" {
-				postfix = append(postfix, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
-			}
-			if len(operators) == 0 || operators[len(operators)-1] != "(" {
-				panic("Неверное выражение: непарные скобки")
-			}
-			operators = operators[:len(operators)-1]
-		} else {
-			for len(operators) > 0 && precedence(token) <= precedence(operators[len(operators)-1]) {
-				postfix = append(postfix, operators[len(operators)-1])
-				operators = operators[:len(operators)-1]
-				if token != "^" && token != "-" && token != "*" && token != "/" && token != "+" {
-					panic("Неверное выражение: неизвестный оператор")
-				}
-			}
-			operators = append(operators, token)
-		}
-	}
-	for len(operators) > 0 {
-		postfix = append(postfix, operators[len(operators)-1])
-		operators = operators[:len(operators)-1]
+	id, token, err := register(cfg)
+	if err != nil {
+		return 0, "", err
 	}
-	return postfix
-}
-
-func evaluatePostfix(postfix []string) (float64, error) {
-	var stack []float64
-	for _, token := range postfix {
-		if isNumber(token) {
-			num, err := strconv.ParseFloat(token, 64)
-			if err != nil {
-				return 0, fmt.Errorf("ошибка преобразования числа: %v", err)
-			}
-			stack = append(stack, num)
-		} else if token == "^" || token == "-" || token == "*" || token == "/" || token == "+" {
-			if len(stack) < 2 {
-				return 0, fmt.Errorf("недостаточно операндов для выполнения операции: %s", token)
-			}
-			operand2 := stack[len(stack)-1]
-			operand1 := stack[len(stack)-2]
-			stack = stack[:len(stack)-2]
-			switch token {
-			case "+":
-				stack = append(stack, operand1+operand2)
-			case "-":
-				stack = append(stack, operand1-operand2)
-			case "*":
-				stack = append(stack, operand1*operand2)
-			case "^":
-				stack = append(stack, math.Pow(operand1, operand2))
-			case "/":
-				if operand2 == 0 {
-					return 0, fmt.Errorf("деление на ноль")
-				}
-				stack = append(stack, operand1/operand2)
-			}
-		} else {
-			return 0, fmt.Errorf("неподдерживаемые операнды")
+	if cfg.StateFile != "" {
+		if err := saveState(cfg.StateFile, agentState{AgentID: id, Token: token}); err != nil {
+			return 0, "", err
 		}
 	}
-	if len(stack) != 1 {
-		return 0, fmt.Errorf("неверное количество операндов: %d", len(stack))
-	}
-	return stack[0], nil
+	return id, token, nil
 }
 
-func isNumber(str string) bool {
-	_, err := strconv.ParseFloat(str, 64)
-	return err == nil
-}
-
-func precedence(op string) int {
-	switch op {
-	case "+", "-":
-		return 1
-	case "*", "/":
-		return 2
-	case "^":
-		return 3
-	default:
-		return 0
+// evaluateExpression разбирает и вычисляет операцию в режиме numeric с переменными и функциями
+// пользователя из env. Перед каждой выполняемой операцией агент ждёт её время по модели cost.
+func evaluateExpression(ctx context.Context, expression string, numeric expr.Numeric, env expr.Env, cost CostModel) (string, error) {
+	tree, err := expr.Parse(expression)
+	if err != nil {
+		return "", err
 	}
+	env.Step = costStep(ctx, tree, numeric, cost)
+	result, err := numeric.EvalWith(tree, env)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", ctxErr
+	}
+	return result, err
 }
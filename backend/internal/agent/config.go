@@ -0,0 +1,291 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"calc/backend/internal/expr"
+)
+
+// Timings — время выполнения операций в миллисекундах,
+// которое агент использует, если оркестратор его не прислал
+type Timings struct {
+	Addition       int `json:"addition"`
+	Subtraction    int `json:"subtraction"`
+	Multiplication int `json:"multiplication"`
+	Division       int `json:"division"`
+	Exponent       int `json:"exponent"`
+	// Время выполнения функций по имени функции
+	Functions map[string]int `json:"functions,omitempty"`
+	// Время остальных операторов: % // < <= > >= == != && || ! и ?: (условный оператор)
+	Operators map[string]int `json:"operators,omitempty"`
+}
+
+// Операторы, время которых задаётся в Timings.Operators
+var timedOperators = []string{"%", "//", "<", "<=", ">", ">=", "==", "!=", "&&", "||", "!", "?:"}
+
+func isTimedOperator(op string) bool {
+	for _, timed := range timedOperators {
+		if op == timed {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFunctions переопределяет время перечисленных функций, остальные не меняются
+func (t *Timings) SetFunctions(functions map[string]int) {
+	t.Functions = mergeTimings(t.Functions, functions)
+}
+
+// SetOperators переопределяет время перечисленных операторов, остальные не меняются
+func (t *Timings) SetOperators(operators map[string]int) {
+	t.Operators = mergeTimings(t.Operators, operators)
+}
+
+func mergeTimings(dst, src map[string]int) map[string]int {
+	if dst == nil {
+		dst = make(map[string]int)
+	}
+	for name, ms := range src {
+		dst[name] = ms
+	}
+	return dst
+}
+
+// CheckCosts проверяет имена и время функций и операторов
+func (t Timings) CheckCosts() error {
+	for name, ms := range t.Functions {
+		if !expr.IsFunction(name) {
+			return fmt.Errorf("неизвестная функция %q", name)
+		}
+		if ms < 0 {
+			return fmt.Errorf("время функций не может быть отрицательным")
+		}
+	}
+	for op, ms := range t.Operators {
+		if !isTimedOperator(op) {
+			return fmt.Errorf("неизвестный оператор %q", op)
+		}
+		if ms < 0 {
+			return fmt.Errorf("время операторов не может быть отрицательным")
+		}
+	}
+	return nil
+}
+
+// ParseFunctionTimings разбирает время функций, записанное как "sqrt=100, sin=300"
+func ParseFunctionTimings(s string) (map[string]int, error) {
+	return parseTimings(s, "функции", expr.IsFunction)
+}
+
+// ParseOperatorTimings разбирает время операторов, записанное как "%=100, <==50, ?:=10"
+func ParseOperatorTimings(s string) (map[string]int, error) {
+	return parseTimings(s, "оператора", isTimedOperator)
+}
+
+// parseTimings разбирает пары имя=мс через запятую. Имя отделяется по последнему знаку =,
+// поэтому в именах операторов вроде <= и == он тоже допустим.
+func parseTimings(s, kind string, known func(string) bool) (map[string]int, error) {
+	timings := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("время %s нужно указать как имя=мс, получено %q", kind, pair)
+		}
+		name, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if !known(name) {
+			return nil, fmt.Errorf("неизвестное имя %s %q", kind, name)
+		}
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("время %s %s должно быть неотрицательным целым числом, получено %q", kind, name, value)
+		}
+		timings[name] = ms
+	}
+	return timings, nil
+}
+
+// Config — настройки агента
+type Config struct {
+	// Адрес gRPC сервера оркестратора
+	OrchestratorAddr string `json:"orchestrator"`
+	// Имя агента, по которому он находит свою запись при повторном запуске
+	Name string `json:"name"`
+	// Пользователь, которому принадлежит агент. Необязателен: пользователь берётся из UserToken.
+	User string `json:"user"`
+	// Access токен пользователя, которым агент подтверждает право зарегистрироваться.
+	// После регистрации агент работает со своим токеном.
+	UserToken string `json:"user_token"`
+	// Файл, в котором агент хранит выданные при регистрации ID и токен и с которыми
+	// подключается после перезапуска. Если файл уже есть, токен пользователя не нужен.
+	StateFile string `json:"state_file"`
+	// Организация, в общий пул которой входит агент; пустая — личный агент пользователя
+	Org string `json:"org"`
+	// Число вычислителей
+	Capacity int `json:"capacity"`
+
+	// Подключение к оркестратору по TLS
+	TLS           bool   `json:"tls"`
+	TLSCAFile     string `json:"tls_ca_file"`
+	TLSServerName string `json:"tls_server_name"`
+
+	Timings Timings `json:"timings"`
+	// Время операций, которое агент использует вместо присланного оркестратором, по оператору или имени функции
+	CostOverrides map[string]int `json:"cost_overrides,omitempty"`
+	// Выполнять операции без задержки
+	ZeroCost bool `json:"zero_cost"`
+}
+
+// DefaultConfig возвращает настройки агента по умолчанию
+func DefaultConfig() Config {
+	return Config{
+		OrchestratorAddr: "localhost:8079",
+		Capacity:         1,
+		Timings: Timings{
+			Addition:       200,
+			Subtraction:    200,
+			Multiplication: 200,
+			Division:       200,
+			Exponent:       200,
+			Functions:      defaultTimings(expr.Functions()),
+			Operators:      defaultTimings(timedOperators),
+		},
+	}
+}
+
+// defaultTimings возвращает время по умолчанию для всех перечисленных функций или операторов
+func defaultTimings(names []string) map[string]int {
+	timings := make(map[string]int)
+	for _, name := range names {
+		timings[name] = 200
+	}
+	return timings
+}
+
+// LoadConfigFile дополняет настройки значениями из JSON файла
+func (c *Config) LoadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения файла настроек: %v", err)
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("ошибка разбора файла настроек %s: %v", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv дополняет настройки значениями из переменных окружения
+func (c *Config) ApplyEnv() error {
+	stringVars := map[string]*string{
+		"ORCHESTRATOR_ADDR":     &c.OrchestratorAddr,
+		"AGENT_NAME":            &c.Name,
+		"AGENT_USER":            &c.User,
+		"AGENT_USER_TOKEN":      &c.UserToken,
+		"AGENT_STATE":           &c.StateFile,
+		"AGENT_ORG":             &c.Org,
+		"AGENT_TLS_CA":          &c.TLSCAFile,
+		"AGENT_TLS_SERVER_NAME": &c.TLSServerName,
+	}
+	for name, field := range stringVars {
+		if value := os.Getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	intVars := map[string]*int{
+		"COMPUTING_POWER":         &c.Capacity,
+		"TIME_ADDITION_MS":        &c.Timings.Addition,
+		"TIME_SUBTRACTION_MS":     &c.Timings.Subtraction,
+		"TIME_MULTIPLICATIONS_MS": &c.Timings.Multiplication,
+		"TIME_DIVISIONS_MS":       &c.Timings.Division,
+		"TIME_EXPONENT_MS":        &c.Timings.Exponent,
+	}
+	for name, field := range intVars {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s должно быть целым числом, получено %q", name, value)
+		}
+		*field = n
+	}
+
+	if value := os.Getenv("TIME_FUNCTIONS_MS"); value != "" {
+		functions, err := ParseFunctionTimings(value)
+		if err != nil {
+			return fmt.Errorf("TIME_FUNCTIONS_MS: %v", err)
+		}
+		c.Timings.SetFunctions(functions)
+	}
+	if value := os.Getenv("TIME_OPERATORS_MS"); value != "" {
+		operators, err := ParseOperatorTimings(value)
+		if err != nil {
+			return fmt.Errorf("TIME_OPERATORS_MS: %v", err)
+		}
+		c.Timings.SetOperators(operators)
+	}
+	if value := os.Getenv("COST_OVERRIDES_MS"); value != "" {
+		costs, err := ParseCostOverrides(value)
+		if err != nil {
+			return fmt.Errorf("COST_OVERRIDES_MS: %v", err)
+		}
+		c.SetCostOverrides(costs)
+	}
+
+	boolVars := map[string]*bool{
+		"AGENT_TLS":       &c.TLS,
+		"AGENT_ZERO_COST": &c.ZeroCost,
+	}
+	for name, field := range boolVars {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s должно быть true или false, получено %q", name, value)
+		}
+		*field = enabled
+	}
+	return nil
+}
+
+// SetCostOverrides переопределяет время перечисленных операций агента, остальные не меняются
+func (c *Config) SetCostOverrides(costs map[string]int) {
+	c.CostOverrides = mergeTimings(c.CostOverrides, costs)
+}
+
+// Validate проверяет, что настроек достаточно для запуска агента
+func (c Config) Validate() error {
+	if c.OrchestratorAddr == "" {
+		return fmt.Errorf("не задан адрес оркестратора")
+	}
+	if c.UserToken == "" && c.StateFile == "" {
+		return fmt.Errorf("не задан токен пользователя для регистрации агента")
+	}
+	if c.Capacity < 1 {
+		return fmt.Errorf("число вычислителей должно быть положительным, получено %d", c.Capacity)
+	}
+	for _, ms := range []int{c.Timings.Addition, c.Timings.Subtraction, c.Timings.Multiplication, c.Timings.Division, c.Timings.Exponent} {
+		if ms < 0 {
+			return fmt.Errorf("время операций не может быть отрицательным")
+		}
+	}
+	if err := c.Timings.CheckCosts(); err != nil {
+		return err
+	}
+	if err := checkCostOverrides(c.CostOverrides); err != nil {
+		return fmt.Errorf("время операций агента: %v", err)
+	}
+	return nil
+}
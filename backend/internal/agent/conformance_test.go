@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"calc/backend/internal/expr"
+)
+
+// conformanceCase — выражение, режим вычислений, значения переменных, функции пользователя
+// и результат, который должен получить вычислитель агента.
+// Пустой режим означает float64. Если ожидается ошибка, err задаёт её вид.
+type conformanceCase struct {
+	expression string
+	mode       expr.Mode
+	vars       map[string]string
+	funcs      map[string]string
+	want       string
+	err        error
+}
+
+var errSyntax = errors.New("синтаксическая ошибка")
+
+// Каверзные случаи приоритета и ассоциативности операторов
+var conformanceCases = []conformanceCase{
+	// Степень правоассоциативна
+	{expression: "2^3^2", want: "512"},
+	{expression: "(2^3)^2", want: "64"},
+	{expression: "2^3^0", want: "2"},
+	{expression: "4^0.5", want: "2"},
+
+	// Степень сильнее унарного минуса слева и слабее справа
+	{expression: "-2^2", want: "-4"},
+	{expression: "(-2)^2", want: "4"},
+	{expression: "2^-1", want: "0.5"},
+	{expression: "-2^-2", want: "-0.25"},
+	{expression: "2^-1^2", want: "0.5"},
+	{expression: "--2^2", want: "4"},
+	{expression: "-(2+3)^2", want: "-25"},
+
+	// Степень сильнее умножения, в том числе неявного
+	{expression: "2*3^2", want: "18"},
+	{expression: "2^3*2", want: "16"},
+	{expression: "2(3)^2", want: "18"},
+	{expression: "2^2(3)", want: "12"},
+	{expression: "(1+2)(3+4)", want: "21"},
+
+	// Остальные операторы левоассоциативны
+	{expression: "8/2/2", want: "2"},
+	{expression: "7-3-2", want: "2"},
+	{expression: "2-3+4", want: "3"},
+	{expression: "100/10*10", want: "100"},
+	{expression: "2+3*4-5", want: "9"},
+	{expression: "1-(-1)", want: "2"},
+	{expression: "5--3", want: "8"},
+
+	// Функции и константы
+	{expression: "2sqrt(16)", want: "8"},
+	{expression: "max(1, 5, 3)-min(4, 2)", want: "3"},
+	{expression: "-abs(-3)^2", want: "-9"},
+	{expression: "round(-2.5)", want: "-3"},
+	{expression: "log(1000)+ln(1)", want: "3"},
+	{expression: "cos(0)+floor(pi)", want: "4"},
+	{expression: "sqrt(9/4)", mode: expr.ModeRat, want: "3/2"},
+	{expression: "floor(-7/2)", mode: expr.ModeRat, want: "-4"},
+	{expression: "sqrt(17)", mode: expr.ModeInt, want: "4"},
+
+	// Остаток, целочисленное деление, сравнения и логические операторы
+	{expression: "7%3 + -7%3 + 7%-3", want: "1"},
+	{expression: "7//2 + -7//2", want: "-1"},
+	{expression: "1+1 == 2 && 2 < 3*1", want: "1"},
+	{expression: "2 < 3 == 1", want: "1"},
+	{expression: "!0 + !5", want: "1"},
+	{expression: "0 && 1/0", want: "0"},
+	{expression: "1 || 1/0", want: "1"},
+	{expression: "0 ? 1/0 : 3", want: "3"},
+	{expression: "0 ? 2 : 0 ? 3 : 4", want: "4"},
+	{expression: "-7//2*10 + -7%2", mode: expr.ModeInt, want: "-39"},
+	{expression: "0.1+0.2 == 0.3", mode: expr.ModeRat, want: "1"},
+
+	// Точные режимы
+	{expression: "1/3+1/6", mode: expr.ModeRat, want: "1/2"},
+	{expression: "0.1+0.2", mode: expr.ModeRat, want: "3/10"},
+	{expression: "-1/2^2", mode: expr.ModeRat, want: "-1/4"},
+	{expression: "(1/2)^-2", mode: expr.ModeRat, want: "4"},
+	{expression: "(-1/3)*3", mode: expr.ModeRat, want: "-1"},
+	{expression: "-1/3+1/3", mode: expr.ModeRat, want: "0"},
+	{expression: "-7/2", mode: expr.ModeInt, want: "-3"},
+	{expression: "2^100", mode: expr.ModeInt, want: "1267650600228229401496703205376"},
+	{expression: "0.1+0.2", mode: expr.ModeFloat, want: "0.3"},
+	{expression: "2^-3", mode: expr.ModeFloat, want: "0.125"},
+
+	// Ошибки
+	{expression: "1/0", err: expr.ErrDivisionByZero},
+	{expression: "1/(1/2-0.5)", mode: expr.ModeRat, err: expr.ErrDivisionByZero},
+	{expression: "2^", err: errSyntax},
+	{expression: "(2+3", err: errSyntax},
+	{expression: "sqrt(1, 2)", err: errSyntax},
+	{expression: "1 ? 2", err: errSyntax},
+	{expression: "5 % 0", err: expr.ErrDivisionByZero},
+	{expression: "sin(1)", mode: expr.ModeRat, err: errSyntax},
+
+	// Переменные и присваивание
+	{expression: "x^2 + y", vars: map[string]string{"x": "12", "y": "0.5"}, want: "144.5"},
+	{expression: "2x", vars: map[string]string{"x": "-3"}, want: "-6"},
+	{expression: "x + 1/6", mode: expr.ModeRat, vars: map[string]string{"x": "1/3"}, want: "1/2"},
+	{expression: "x = 3*4", want: "12"},
+	{expression: "pi = 3", err: errSyntax},
+	{expression: "x = 1 = 2", err: errSyntax},
+	{expression: "x = f(a) = 2", err: errSyntax},
+
+	// Функции пользователя
+	{expression: "f(3, 1) + 1", funcs: map[string]string{"f": "f(x, y) = x^2 + 2*x*y"}, want: "16"},
+	{expression: "g(2)", funcs: map[string]string{"f": "f(x) = x*x", "g": "g(x) = f(x) + f(x+1)"}, want: "13"},
+	{expression: "f(x)", vars: map[string]string{"x": "1/2"}, funcs: map[string]string{"f": "f(x) = 2x"}, mode: expr.ModeRat, want: "1"},
+	{expression: "f(1)", funcs: map[string]string{"f": "f(x) = sin(x)"}, mode: expr.ModeRat, err: errSyntax},
+	{expression: "sqrt(x) = 1", err: errSyntax},
+	{expression: "f(x, x) = 1", err: errSyntax},
+}
+
+// TestConformance прогоняет вычислитель агента по набору каверзных выражений
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceCases {
+		numeric, err := expr.NewNumeric(string(c.mode), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcs, err := expr.ParseDefinitions(c.funcs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := evaluateExpression(context.Background(), c.expression, numeric, expr.Env{Vars: c.vars, Funcs: funcs}, ZeroCost{})
+		if problem := checkCase(c, got, err); problem != "" {
+			t.Errorf("%s [%s]: %s", c.expression, numeric.Mode, problem)
+		}
+	}
+}
+
+// checkCase сравнивает результат вычисления с ожидаемым и описывает расхождение
+func checkCase(c conformanceCase, got string, err error) string {
+	var syntaxErr *expr.SyntaxError
+	switch {
+	case c.err == errSyntax:
+		if !errors.As(err, &syntaxErr) {
+			return fmt.Sprintf("ожидалась синтаксическая ошибка, получено %q (ошибка: %v)", got, err)
+		}
+	case c.err != nil:
+		if !errors.Is(err, c.err) {
+			return fmt.Sprintf("ожидалась ошибка %q, получено %q (ошибка: %v)", c.err, got, err)
+		}
+	case err != nil:
+		return fmt.Sprintf("ожидалось %v, получена ошибка %v", c.want, err)
+	case got != c.want:
+		return fmt.Sprintf("ожидалось %s, получено %s", c.want, got)
+	}
+	return ""
+}
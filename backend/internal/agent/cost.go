@@ -0,0 +1,164 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"calc/backend/internal/expr"
+)
+
+// CostModel задаёт, сколько времени стоит одна выполненная операция.
+// op — бинарный оператор, "!", "?:" или имя функции, в том числе функции пользователя.
+type CostModel interface {
+	Cost(op string) time.Duration
+}
+
+// Cost возвращает время операции op. Функции пользователя ничего не стоят сами по себе,
+// время занимают операции их тела.
+func (t Timings) Cost(op string) time.Duration {
+	var ms int
+	switch op {
+	case "+":
+		ms = t.Addition
+	case "-":
+		ms = t.Subtraction
+	case "*":
+		ms = t.Multiplication
+	case "/":
+		ms = t.Division
+	case "^":
+		ms = t.Exponent
+	default:
+		if expr.IsFunction(op) {
+			ms = t.Functions[op]
+		} else {
+			ms = t.Operators[op]
+		}
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Costs возвращает время всех операций по оператору или имени функции, как его передают агенту
+func (t Timings) Costs() map[string]int {
+	costs := map[string]int{
+		"+": t.Addition,
+		"-": t.Subtraction,
+		"*": t.Multiplication,
+		"/": t.Division,
+		"^": t.Exponent,
+	}
+	for name, ms := range t.Functions {
+		costs[name] = ms
+	}
+	for op, ms := range t.Operators {
+		costs[op] = ms
+	}
+	return costs
+}
+
+// ZeroCost — модель, в которой все операции выполняются мгновенно, например для проверки вычислителя
+type ZeroCost struct{}
+
+func (ZeroCost) Cost(string) time.Duration { return 0 }
+
+// Overrides — модель Base, в которой время части операций в миллисекундах задано самим агентом.
+// Так медленный или быстрый агент считает с собственным временем, что бы ни прислал оркестратор.
+type Overrides struct {
+	Base  CostModel
+	Costs map[string]int
+}
+
+func (o Overrides) Cost(op string) time.Duration {
+	if ms, ok := o.Costs[op]; ok {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return o.Base.Cost(op)
+}
+
+// Операторы, время которых задаётся полями Timings, а не Timings.Operators
+var basicOperators = []string{"+", "-", "*", "/", "^"}
+
+// isCostName сообщает, что у name есть время выполнения: это оператор или встроенная функция
+func isCostName(name string) bool {
+	for _, op := range basicOperators {
+		if name == op {
+			return true
+		}
+	}
+	return isTimedOperator(name) || expr.IsFunction(name)
+}
+
+// ParseCostOverrides разбирает время операций агента, записанное как "+=10, sqrt=0, ?:=5"
+func ParseCostOverrides(s string) (map[string]int, error) {
+	return parseTimings(s, "операции", isCostName)
+}
+
+// costModel возвращает модель, с которой агент считает операцию:
+// время из запроса requested и поверх него время, заданное агентом
+func (c Config) costModel(requested CostModel) CostModel {
+	if c.ZeroCost {
+		return ZeroCost{}
+	}
+	if len(c.CostOverrides) == 0 {
+		return requested
+	}
+	return Overrides{Base: requested, Costs: c.CostOverrides}
+}
+
+// costStep возвращает обработчик, который перед каждой выполняемой операцией дерева tree ждёт её время.
+// В режиме rat операнд вида (1/3) или (-1/3) — это промежуточный результат, записанный дробью,
+// а не деление, поэтому он ничего не стоит.
+func costStep(ctx context.Context, tree expr.Node, numeric expr.Numeric, cost CostModel) func(op string, n expr.Node) error {
+	fractions := make(map[expr.Node]bool)
+	if numeric.Mode == expr.ModeRat {
+		expr.Inspect(tree, func(n expr.Node) bool {
+			if b, ok := n.(*expr.Binary); ok && n != tree && isFraction(b) {
+				fractions[n] = true
+			}
+			return true
+		})
+	}
+	return func(op string, n expr.Node) error {
+		if fractions[n] {
+			return nil
+		}
+		delay := cost.Cost(op)
+		if delay <= 0 {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// isFraction сообщает, что операция — дробь из двух чисел, например 1/3 или -1/3.
+// Отрицательную дробь парсер читает как (-1)/3.
+func isFraction(b *expr.Binary) bool {
+	left := b.Left
+	if u, ok := left.(*expr.Unary); ok && u.Op == "-" {
+		left = u.Operand
+	}
+	_, numerator := left.(*expr.NumberLit)
+	_, denominator := b.Right.(*expr.NumberLit)
+	return b.Op == "/" && numerator && denominator
+}
+
+// checkCostOverrides проверяет время операций, заданное агентом
+func checkCostOverrides(costs map[string]int) error {
+	for name, ms := range costs {
+		if !isCostName(name) {
+			return fmt.Errorf("неизвестная операция %q", name)
+		}
+		if ms < 0 {
+			return fmt.Errorf("время операции %s не может быть отрицательным", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"calc/backend/internal/expr"
+)
+
+// recordingCost — мгновенная модель, которая запоминает оплаченные операции
+type recordingCost struct {
+	ops []string
+}
+
+func (c *recordingCost) Cost(op string) time.Duration {
+	c.ops = append(c.ops, op)
+	return 0
+}
+
+// В режиме rat дробь из чисел, в том числе отрицательная, — промежуточный результат и ничего не стоит,
+// а деление всего выражения и деления в других режимах оплачиваются
+func TestFractionCost(t *testing.T) {
+	cases := []struct {
+		expression string
+		mode       expr.Mode
+		charged    string
+	}{
+		{expression: "(1/3)*3", mode: expr.ModeRat, charged: "*"},
+		{expression: "(-1/3)*3", mode: expr.ModeRat, charged: "*"},
+		{expression: "-1/3+1/6", mode: expr.ModeRat, charged: "+"},
+		{expression: "-1/3", mode: expr.ModeRat, charged: "/"},
+		{expression: "(-1/3)*3", mode: expr.ModeFloat64, charged: "/ *"},
+		{expression: "(-(1+2)/3)*3", mode: expr.ModeRat, charged: "+ / *"},
+	}
+
+	for _, c := range cases {
+		numeric, err := expr.NewNumeric(string(c.mode), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cost := &recordingCost{}
+		if _, err := evaluateExpression(context.Background(), c.expression, numeric, expr.Env{}, cost); err != nil {
+			t.Errorf("%s [%s]: ошибка вычисления: %v", c.expression, c.mode, err)
+			continue
+		}
+		if got := strings.Join(cost.ops, " "); got != c.charged {
+			t.Errorf("%s [%s]: оплачены операции %q, ожидались %q", c.expression, c.mode, got, c.charged)
+		}
+	}
+}
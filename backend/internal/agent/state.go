@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// agentState — ID и токен, которые оркестратор выдал агенту при регистрации.
+// Access токен пользователя живёт несколько минут, поэтому агент сохраняет свои ID и токен
+// в файле и после перезапуска подключается с ними, не регистрируясь заново.
+type agentState struct {
+	AgentID int    `json:"agent_id"`
+	Token   string `json:"token"`
+}
+
+// loadState читает сохранённую регистрацию. Если файла нет, ok равно false.
+func loadState(path string) (state agentState, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return agentState{}, false, nil
+	}
+	if err != nil {
+		return agentState{}, false, fmt.Errorf("ошибка чтения файла состояния агента: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return agentState{}, false, fmt.Errorf("ошибка разбора файла состояния агента %s: %v", path, err)
+	}
+	if state.AgentID == 0 || state.Token == "" {
+		return agentState{}, false, fmt.Errorf("в файле состояния агента %s нет ID или токена", path)
+	}
+	return state, true, nil
+}
+
+// saveState сохраняет регистрацию агента. Токен даёт право работать от имени агента,
+// поэтому файл доступен только владельцу.
+func saveState(path string, state agentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("ошибка записи файла состояния агента: %v", err)
+	}
+	return nil
+}
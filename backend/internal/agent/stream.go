@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	orchest "calc/backend/internal/proto/orchest"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Как часто агент отправляет пульс оркестратору
+const heartbeatInterval = 7 * time.Second
+
+// Через сколько агент переподключается после обрыва сессии
+const reconnectInterval = 2 * time.Second
+
+// Как часто агент сообщает о прогрессе выполняемой задачи. Оркестратор сдаёт задачу в аренду
+// на 30 секунд и продлевает аренду при каждом сообщении, поэтому интервал заметно меньше.
+var progressInterval = 10 * time.Second
+
+// queuedTask — задача, ожидающая свободного вычислителя
+type queuedTask struct {
+	ctx  context.Context
+	task *orchest.Task
+}
+
+// stream — сессия агента с оркестратором. Отправка в gRPC поток
+// не потокобезопасна, поэтому все сообщения идут через send.
+type stream struct {
+	mu     sync.Mutex
+	client orchest.Orchestrator_ConnectClient
+
+	tasksMu sync.Mutex
+	tasks   map[int64]context.CancelFunc
+
+	// Очередь задач для вычислителей и число занятых вычислителей
+	queue chan queuedTask
+	load  int32
+}
+
+func (s *stream) send(msg *orchest.AgentMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client.Send(msg)
+}
+
+// serve держит сессию с оркестратором и переподключается, если она оборвалась.
+// Возвращается, только если оркестратор не признал ID или токен агента или пользователь агента
+// больше не может подключать агентов к организации: переподключение тут не поможет.
+func serve(cfg Config, id int, token string) error {
+	log.Printf("starting agent %d with %d calculators...", id, cfg.Capacity)
+	for {
+		err := connect(cfg, id, token)
+		if code := status.Code(err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+			return fmt.Errorf("оркестратор не принял агента %d: %v", id, err)
+		}
+		log.Printf("Сессия с оркестратором прервана: %v", err)
+		time.Sleep(reconnectInterval)
+	}
+}
+
+// connect открывает один долгоживущий поток с оркестратором: по нему идут пульс,
+// задачи, прогресс, результаты и отмены. Задачи вычисляют cfg.Capacity вычислителей.
+func connect(cfg Config, id int, token string) error {
+	conn, err := dial(cfg, agentCredentials{agentID: fmt.Sprint(id), token: token, secure: cfg.TLS})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := orchest.NewOrchestratorClient(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	connectClient, err := client.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("ошибка при вызове метода Connect на оркестраторе: %v", err)
+	}
+	s := &stream{
+		client: connectClient,
+		tasks:  make(map[int64]context.CancelFunc),
+		queue:  make(chan queuedTask, cfg.Capacity),
+	}
+
+	// Представляемся оркестратору и сообщаем, сколько операций можем вычислять одновременно
+	hello := &orchest.AgentMessage{
+		Payload: &orchest.AgentMessage_Hello{
+			Hello: &orchest.AgentInfo{AgentId: fmt.Sprint(id), User: cfg.User, Capacity: int32(cfg.Capacity)},
+		},
+	}
+	if err := s.send(hello); err != nil {
+		return err
+	}
+
+	go s.heartbeat(ctx)
+	for i := 0; i < cfg.Capacity; i++ {
+		go s.worker(ctx, id, cfg)
+	}
+
+	for {
+		msg, err := connectClient.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *orchest.OrchestratorMessage_Task:
+			task := payload.Task
+			taskCtx, taskCancel := context.WithCancel(ctx)
+			s.tasksMu.Lock()
+			s.tasks[task.GetId()] = taskCancel
+			s.tasksMu.Unlock()
+			// Пока все вычислители заняты, задача ждёт в стороне, чтобы приём отмен не останавливался.
+			// Отменённая до начала вычисления задача в очередь не попадает.
+			go func(qt queuedTask) {
+				select {
+				case s.queue <- qt:
+				case <-qt.ctx.Done():
+				}
+			}(queuedTask{ctx: taskCtx, task: task})
+		case *orchest.OrchestratorMessage_Cancel:
+			log.Printf("Задача %d отменена: %s", payload.Cancel.GetTaskId(), payload.Cancel.GetReason())
+			s.finish(payload.Cancel.GetTaskId())
+		}
+	}
+}
+
+// worker — один вычислитель агента
+func (s *stream) worker(ctx context.Context, id int, cfg Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case qt := <-s.queue:
+			if qt.ctx.Err() != nil {
+				// Задачу отменили, пока она ждала вычислителя
+				continue
+			}
+			atomic.AddInt32(&s.load, 1)
+			s.runTask(qt.ctx, id, qt.task, cfg)
+			atomic.AddInt32(&s.load, -1)
+		}
+	}
+}
+
+// agentCredentials передаёт токен в метаданных каждого вызова: при регистрации — токен пользователя,
+// дальше — ID агента и токен, выданный ему при регистрации
+type agentCredentials struct {
+	agentID string
+	token   string
+	secure  bool
+}
+
+func (c agentCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := map[string]string{"authorization": "Bearer " + c.token}
+	if c.agentID != "" {
+		md["agent-id"] = c.agentID
+	}
+	return md, nil
+}
+
+// RequireTransportSecurity не даёт отправить токен открытым текстом, если агент настроен на TLS
+func (c agentCredentials) RequireTransportSecurity() bool { return c.secure }
+
+// dial открывает соединение с оркестратором, в каждом вызове которого агент подтверждает себя токеном
+func dial(cfg Config, auth agentCredentials) (*grpc.ClientConn, error) {
+	creds, err := transportCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(cfg.OrchestratorAddr, grpc.WithTransportCredentials(creds), grpc.WithPerRPCCredentials(auth))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при наборе соединения с оркестратором: %v", err)
+	}
+	return conn, nil
+}
+
+// transportCredentials возвращает TLS или небезопасные учетные данные в зависимости от настроек
+func transportCredentials(cfg Config) (credentials.TransportCredentials, error) {
+	if !cfg.TLS {
+		return insecure.NewCredentials(), nil
+	}
+	if cfg.TLSCAFile != "" {
+		creds, err := credentials.NewClientTLSFromFile(cfg.TLSCAFile, cfg.TLSServerName)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка загрузки сертификата CA: %v", err)
+		}
+		return creds, nil
+	}
+	// Без своего CA проверяем сертификат оркестратора системными корневыми сертификатами
+	return credentials.NewTLS(&tls.Config{ServerName: cfg.TLSServerName}), nil
+}
+
+// heartbeat периодически отправляет пульс с текущей загрузкой, пока сессия жива
+func (s *stream) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			msg := &orchest.AgentMessage{
+				Payload: &orchest.AgentMessage_Heartbeat{Heartbeat: &orchest.Heartbeat{Load: atomic.LoadInt32(&s.load)}},
+			}
+			if err := s.send(msg); err != nil {
+				log.Printf("Ошибка при отправке пульса: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// finish отменяет контекст задачи и убирает её из списка выполняемых
+func (s *stream) finish(taskID int64) {
+	s.tasksMu.Lock()
+	cancel, ok := s.tasks[taskID]
+	delete(s.tasks, taskID)
+	s.tasksMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// reportProgress сообщает о прогрессе задачи сразу и затем каждые progressInterval, пока не закрыт done
+func (s *stream) reportProgress(ctx context.Context, taskID int64, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	progress := &orchest.AgentMessage{
+		Payload: &orchest.AgentMessage_Progress{Progress: &orchest.Progress{TaskId: taskID}},
+	}
+	for {
+		if err := s.send(progress); err != nil {
+			log.Printf("Ошибка при отправке прогресса задачи %d: %v", taskID, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runTask вычисляет задачу и отправляет результат, если её не отменили.
+// Пока задача вычисляется, агент сообщает о прогрессе, чтобы оркестратор не отдал её другому агенту.
+func (s *stream) runTask(ctx context.Context, id int, task *orchest.Task, cfg Config) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.reportProgress(ctx, task.GetId(), done)
+	}()
+
+	res := &orchest.TaskResult{
+		TaskId:  task.GetId(),
+		AgentId: fmt.Sprint(id),
+	}
+	result, err := CalculateExpression(ctx, task.GetRequest(), cfg)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Result = result
+	}
+
+	// Отменённую задачу оркестратор уже отдал другому агенту
+	if ctx.Err() != nil {
+		return
+	}
+	s.finish(task.GetId())
+
+	msg := &orchest.AgentMessage{Payload: &orchest.AgentMessage_Result{Result: res}}
+	if err := s.send(msg); err != nil {
+		log.Printf("Ошибка при отправке результата задачи %d: %v", task.GetId(), err)
+	}
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	agentrpc "calc/backend/internal/proto/calc_agent"
+	orchest "calc/backend/internal/proto/orchest"
+)
+
+// recordingClient запоминает сообщения, которые агент отправляет оркестратору, и время их отправки
+type recordingClient struct {
+	orchest.Orchestrator_ConnectClient
+
+	mu       sync.Mutex
+	progress []time.Time
+	results  []*orchest.TaskResult
+}
+
+func (c *recordingClient) Send(msg *orchest.AgentMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch payload := msg.Payload.(type) {
+	case *orchest.AgentMessage_Progress:
+		c.progress = append(c.progress, time.Now())
+	case *orchest.AgentMessage_Result:
+		c.results = append(c.results, payload.Result)
+	}
+	return nil
+}
+
+// Задача, которая вычисляется дольше аренды, продлевает её сообщениями о прогрессе,
+// поэтому оркестратор не отдаёт её другому агенту
+func TestLongTaskKeepsLease(t *testing.T) {
+	const lease = 100 * time.Millisecond
+	defer func(interval time.Duration) { progressInterval = interval }(progressInterval)
+	progressInterval = lease / 4
+
+	client := &recordingClient{}
+	s := &stream{client: client, tasks: make(map[int64]context.CancelFunc)}
+	task := &orchest.Task{
+		Id: 1,
+		Request: &agentrpc.ExpressionRequest{
+			Expression: "1+2",
+			Mode:       "float64",
+			Costs:      map[string]int64{"+": int64(3 * lease / time.Millisecond)},
+		},
+	}
+
+	start := time.Now()
+	s.runTask(context.Background(), 1, task, Config{})
+	finished := time.Now()
+	if elapsed := finished.Sub(start); elapsed < 3*lease {
+		t.Fatalf("задача вычислялась %v, ожидалось не меньше %v", elapsed, 3*lease)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.results) != 1 || client.results[0].GetResult().GetResult() != "3" {
+		t.Fatalf("результаты задачи: %v, ожидался один результат 3", client.results)
+	}
+	if len(client.progress) == 0 {
+		t.Fatal("агент не сообщил о прогрессе задачи")
+	}
+	// Между продлениями аренды, от начала задачи до результата, не должно проходить больше lease
+	last := start
+	for _, at := range append(client.progress, finished) {
+		if gap := at.Sub(last); gap > lease {
+			t.Fatalf("аренда истекла бы: %v без сообщений о прогрессе", gap)
+		}
+		last = at
+	}
+}
@@ -0,0 +1,124 @@
+package expr
+
+import "strings"
+
+// Node — узел дерева выражения
+type Node interface {
+	// Position возвращает место узла в исходном выражении
+	Position() Position
+	// String возвращает узел в виде выражения со скобками вокруг каждой операции
+	String() string
+	node()
+}
+
+// NumberLit — числовой литерал. Value хранит число в том виде, в каком оно записано.
+type NumberLit struct {
+	Value string
+	Pos   Position
+}
+
+// Unary — унарный плюс, минус или логическое отрицание !. Pos указывает на оператор.
+type Unary struct {
+	Op      string
+	Operand Node
+	Pos     Position
+}
+
+// Ident — именованная константа, например pi, или переменная пользователя
+type Ident struct {
+	Name string
+	Pos  Position
+}
+
+// Call — вызов функции, например sqrt(2) или max(1, 2, 3). Pos указывает на имя функции.
+type Call struct {
+	Name string
+	Args []Node
+	Pos  Position
+}
+
+// Ternary — условный оператор Cond ? Then : Else. Вычисляется только выбранная ветвь.
+// Pos указывает на знак ?.
+type Ternary struct {
+	Cond Node
+	Then Node
+	Else Node
+	Pos  Position
+}
+
+// Assign — присваивание Name = Value. Встречается только в корне дерева.
+type Assign struct {
+	Name  string
+	Value Node
+	Pos   Position
+}
+
+// Binary — бинарная операция. Pos указывает на оператор,
+// а при неявном умножении, например 2(3+4), — на открывающую скобку.
+type Binary struct {
+	Op    string
+	Left  Node
+	Right Node
+	Pos   Position
+}
+
+func (n *NumberLit) Position() Position { return n.Pos }
+func (n *Ident) Position() Position     { return n.Pos }
+func (n *Call) Position() Position      { return n.Pos }
+func (n *Unary) Position() Position     { return n.Pos }
+func (n *Ternary) Position() Position   { return n.Pos }
+func (n *Binary) Position() Position    { return n.Pos }
+func (n *Assign) Position() Position    { return n.Pos }
+
+func (n *NumberLit) String() string { return n.Value }
+func (n *Ident) String() string     { return n.Name }
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+	return n.Name + "(" + strings.Join(args, ",") + ")"
+}
+func (n *Unary) String() string { return "(" + n.Op + n.Operand.String() + ")" }
+func (n *Ternary) String() string {
+	return "(" + n.Cond.String() + "?" + n.Then.String() + ":" + n.Else.String() + ")"
+}
+func (n *Binary) String() string {
+	return "(" + n.Left.String() + n.Op + n.Right.String() + ")"
+}
+func (n *Assign) String() string { return n.Name + "=" + n.Value.String() }
+
+func (*NumberLit) node() {}
+func (*Ident) node()     {}
+func (*Call) node()      {}
+func (*Unary) node()     {}
+func (*Ternary) node()   {}
+func (*Binary) node()    {}
+func (*Assign) node()    {}
+
+// Inspect обходит дерево в глубину, начиная с n. Если fn возвращает false,
+// потомки узла не посещаются.
+func Inspect(n Node, fn func(Node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *Call:
+		for _, arg := range n.Args {
+			Inspect(arg, fn)
+		}
+	case *Unary:
+		Inspect(n.Operand, fn)
+	case *Ternary:
+		Inspect(n.Cond, fn)
+		Inspect(n.Then, fn)
+		Inspect(n.Else, fn)
+	case *Binary:
+		Inspect(n.Left, fn)
+		Inspect(n.Right, fn)
+	case *Assign:
+		Inspect(n.Value, fn)
+	case *Definition:
+		Inspect(n.Body, fn)
+	}
+}
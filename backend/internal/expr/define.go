@@ -0,0 +1,188 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxCallDepth — самая длинная цепочка вызовов функций пользователя: f вызывает g, g вызывает h и т.д.
+// Рекурсия запрещена, поэтому глубина вызовов известна заранее и проверяется при определении функции.
+const MaxCallDepth = 32
+
+// Definition — определение функции пользователя f(x, y) = x^2 + 2*x*y.
+// Встречается только в корне дерева. Тело может использовать только параметры, константы
+// и другие функции. Pos указывает на имя функции.
+type Definition struct {
+	Name   string
+	Params []string
+	Body   Node
+	Pos    Position
+}
+
+func (n *Definition) Position() Position { return n.Pos }
+func (n *Definition) String() string {
+	return n.Name + "(" + strings.Join(n.Params, ",") + ")=" + n.Body.String()
+}
+func (*Definition) node() {}
+
+// ParseDefinitions разбирает определения функций пользователя по их именам
+func ParseDefinitions(texts map[string]string) (map[string]*Definition, error) {
+	funcs := make(map[string]*Definition, len(texts))
+	for name, text := range texts {
+		tree, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("функция %s: %v", name, err)
+		}
+		def, ok := tree.(*Definition)
+		if !ok || def.Name != name {
+			return nil, fmt.Errorf("функция %s: %q не её определение", name, text)
+		}
+		funcs[name] = def
+	}
+	return funcs, nil
+}
+
+// CheckCalls проверяет, что все функции, которые вызывает выражение, определены
+// и получают столько аргументов, сколько у них параметров
+func CheckCalls(tree Node, funcs map[string]*Definition) error {
+	var err error
+	Inspect(tree, func(n Node) bool {
+		call, ok := n.(*Call)
+		if !ok || IsFunction(call.Name) {
+			return true
+		}
+		def, ok := funcs[call.Name]
+		switch {
+		case !ok:
+			err = &SyntaxError{Pos: call.Pos, Message: fmt.Sprintf("неизвестная функция %q", call.Name)}
+		case len(call.Args) != len(def.Params):
+			err = &SyntaxError{Pos: call.Pos, Message: fmt.Sprintf("функция %s принимает %s, получено %d", call.Name, arguments(len(def.Params)), len(call.Args))}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// CheckDefinitions проверяет набор функций пользователя целиком: тела используют только
+// свои параметры и константы, вызовы определены, функции не вызывают сами себя, в том числе
+// через другие функции, и цепочки вызовов не длиннее MaxCallDepth. Ошибки имеют тип *SyntaxError.
+func CheckDefinitions(funcs map[string]*Definition) error {
+	for _, name := range sortedNames(funcs) {
+		def := funcs[name]
+		if err := checkBody(def); err != nil {
+			return definitionError(def, err)
+		}
+		if err := CheckCalls(def.Body, funcs); err != nil {
+			return definitionError(def, err)
+		}
+	}
+
+	depths := make(map[string]int)
+	for _, name := range sortedNames(funcs) {
+		def := funcs[name]
+		depth, err := callDepth(name, funcs, depths, nil)
+		if err != nil {
+			return definitionError(def, &SyntaxError{Pos: def.Pos, Message: err.Error()})
+		}
+		if depth > MaxCallDepth {
+			return definitionError(def, &SyntaxError{Pos: def.Pos, Message: fmt.Sprintf("цепочка вызовов длиннее %d функций", MaxCallDepth)})
+		}
+	}
+	return nil
+}
+
+// UsedFunctions возвращает функции пользователя, которые выражение вызывает прямо или через другие функции
+func UsedFunctions(tree Node, funcs map[string]*Definition) map[string]*Definition {
+	used := make(map[string]*Definition)
+	var visit func(Node)
+	visit = func(tree Node) {
+		Inspect(tree, func(n Node) bool {
+			call, ok := n.(*Call)
+			if !ok {
+				return true
+			}
+			if def, ok := funcs[call.Name]; ok && used[call.Name] == nil {
+				used[call.Name] = def
+				visit(def.Body)
+			}
+			return true
+		})
+	}
+	visit(tree)
+	return used
+}
+
+// checkBody проверяет, что тело функции использует только её параметры и константы
+func checkBody(def *Definition) error {
+	params := make(map[string]bool, len(def.Params))
+	for _, param := range def.Params {
+		params[param] = true
+	}
+	var err error
+	Inspect(def.Body, func(n Node) bool {
+		if ident, ok := n.(*Ident); ok && !params[ident.Name] && !IsConstant(ident.Name) {
+			err = &SyntaxError{Pos: ident.Pos, Message: fmt.Sprintf("неизвестный параметр %q", ident.Name)}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// callDepth считает длину самой длинной цепочки вызовов из функции name.
+// path — функции, через которые пришёл обход: встретить одну из них снова означает цикл.
+func callDepth(name string, funcs map[string]*Definition, depths map[string]int, path []string) (int, error) {
+	for i, caller := range path {
+		if caller == name {
+			cycle := append(append([]string(nil), path[i:]...), name)
+			return 0, fmt.Errorf("функции вызывают сами себя: %s", strings.Join(cycle, " → "))
+		}
+	}
+	if depth, ok := depths[name]; ok {
+		return depth, nil
+	}
+
+	path = append(path, name)
+	deepest := 0
+	var err error
+	Inspect(funcs[name].Body, func(n Node) bool {
+		call, ok := n.(*Call)
+		if !ok || err != nil {
+			return err == nil
+		}
+		if _, ok := funcs[call.Name]; !ok {
+			return true
+		}
+		var depth int
+		depth, err = callDepth(call.Name, funcs, depths, path)
+		if depth > deepest {
+			deepest = depth
+		}
+		return err == nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	depths[name] = deepest + 1
+	return deepest + 1, nil
+}
+
+// definitionError добавляет к ошибке имя функции. Позиция синтаксической ошибки остаётся,
+// потому что она указывает в текст этого определения.
+func definitionError(def *Definition, err error) error {
+	if syntaxErr, ok := err.(*SyntaxError); ok {
+		wrapped := *syntaxErr
+		wrapped.Message = fmt.Sprintf("функция %s: %s", def.Name, syntaxErr.Message)
+		return &wrapped
+	}
+	return fmt.Errorf("функция %s: %v", def.Name, err)
+}
+
+func sortedNames(funcs map[string]*Definition) []string {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
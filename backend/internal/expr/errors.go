@@ -0,0 +1,40 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDivisionByZero возвращает Eval при делении на ноль
+var ErrDivisionByZero = errors.New("деление на ноль")
+
+// SyntaxError — ошибка разбора выражения с местом, где она найдена,
+// и списком того, что парсер ожидал там увидеть
+type SyntaxError struct {
+	Pos      Position
+	Message  string
+	Expected []string
+	Found    string
+}
+
+func (e *SyntaxError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "синтаксическая ошибка в позиции %d", e.Pos.Column)
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	if len(e.Expected) > 0 {
+		if e.Message != "" {
+			b.WriteString(",")
+		} else {
+			b.WriteString(":")
+		}
+		fmt.Fprintf(&b, " ожидалось %s", strings.Join(e.Expected, " или "))
+		if e.Found != "" {
+			fmt.Fprintf(&b, ", получено %s", e.Found)
+		}
+	}
+	return b.String()
+}
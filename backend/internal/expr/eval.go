@@ -0,0 +1,50 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+// Eval вычисляет дерево выражения в числах с плавающей точкой
+func Eval(n Node) (float64, error) {
+	value, err := evaluator{a: float64Arithmetic{}}.eval(n)
+	if err != nil {
+		return 0, err
+	}
+	return value.(float64), nil
+}
+
+// evalBinary выполняет бинарную операцию над float64
+func evalBinary(op string, left, right float64) (float64, error) {
+	switch op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/":
+		if right == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return left / right, nil
+	case "//":
+		if right == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(left / right), nil
+	case "%":
+		if right == 0 {
+			return 0, ErrDivisionByZero
+		}
+		// Остаток имеет знак делителя, чтобы a == (a//b)*b + a%b
+		rem := math.Mod(left, right)
+		if rem != 0 && (rem < 0) != (right < 0) {
+			rem += right
+		}
+		return rem, nil
+	case "^":
+		return math.Pow(left, right), nil
+	}
+	return 0, fmt.Errorf("неподдерживаемый оператор %q", op)
+}
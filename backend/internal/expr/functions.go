@@ -0,0 +1,122 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// function — встроенная функция. maxArgs < 0 означает любое число аргументов не меньше minArgs.
+type function struct {
+	minArgs int
+	maxArgs int
+	// float64 вычисляет функцию в режиме float64
+	float64 func(args []float64) (float64, error)
+}
+
+var (
+	errNegativeSqrt   = errors.New("корень из отрицательного числа")
+	errNonPositiveLog = errors.New("логарифм неположительного числа")
+)
+
+// Таблица встроенных функций
+var functions = map[string]function{
+	"sqrt": {minArgs: 1, maxArgs: 1, float64: func(a []float64) (float64, error) {
+		if a[0] < 0 {
+			return 0, errNegativeSqrt
+		}
+		return math.Sqrt(a[0]), nil
+	}},
+	"abs": {minArgs: 1, maxArgs: 1, float64: unary(math.Abs)},
+	"min": {minArgs: 1, maxArgs: -1, float64: func(a []float64) (float64, error) {
+		result := a[0]
+		for _, x := range a[1:] {
+			result = math.Min(result, x)
+		}
+		return result, nil
+	}},
+	"max": {minArgs: 1, maxArgs: -1, float64: func(a []float64) (float64, error) {
+		result := a[0]
+		for _, x := range a[1:] {
+			result = math.Max(result, x)
+		}
+		return result, nil
+	}},
+	"sin":   {minArgs: 1, maxArgs: 1, float64: unary(math.Sin)},
+	"cos":   {minArgs: 1, maxArgs: 1, float64: unary(math.Cos)},
+	"log":   {minArgs: 1, maxArgs: 1, float64: logarithm(math.Log10)},
+	"ln":    {minArgs: 1, maxArgs: 1, float64: logarithm(math.Log)},
+	"exp":   {minArgs: 1, maxArgs: 1, float64: unary(math.Exp)},
+	"floor": {minArgs: 1, maxArgs: 1, float64: unary(math.Floor)},
+	"ceil":  {minArgs: 1, maxArgs: 1, float64: unary(math.Ceil)},
+	// Половина округляется от нуля: round(2.5) = 3, round(-2.5) = -3
+	"round": {minArgs: 1, maxArgs: 1, float64: unary(math.Round)},
+}
+
+// Функции, которые вычисляются точно и поэтому доступны в режимах int, rat и float.
+// sqrt в режиме int возвращает целую часть корня, а в режиме rat — только рациональный корень.
+var exactFunctions = map[string]bool{
+	"sqrt": true, "abs": true, "min": true, "max": true, "floor": true, "ceil": true, "round": true,
+}
+
+// Константы записаны с точностью 100 знаков, этого хватает для big.Float точностью до 332 бит
+var constants = map[string]string{
+	"pi": "3.1415926535897932384626433832795028841971693993751058209749445923078164062862089986280348253421170679",
+	"e":  "2.7182818284590452353602874713526624977572470936999595749669676277240766303535475945713821785251664274",
+}
+
+// IsFunction сообщает, что name — встроенная функция
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+// IsConstant сообщает, что name — встроенная константа
+func IsConstant(name string) bool {
+	_, ok := constants[name]
+	return ok
+}
+
+// Functions возвращает имена встроенных функций по алфавиту
+func Functions() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func unary(fn func(float64) float64) func([]float64) (float64, error) {
+	return func(a []float64) (float64, error) {
+		return fn(a[0]), nil
+	}
+}
+
+func logarithm(fn func(float64) float64) func([]float64) (float64, error) {
+	return func(a []float64) (float64, error) {
+		if a[0] <= 0 {
+			return 0, errNonPositiveLog
+		}
+		return fn(a[0]), nil
+	}
+}
+
+// arity описывает, сколько аргументов принимает функция
+func (f function) arity() string {
+	if f.maxArgs < 0 {
+		return "хотя бы " + arguments(f.minArgs)
+	}
+	return arguments(f.minArgs)
+}
+
+func arguments(n int) string {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return fmt.Sprintf("%d аргумент", n)
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return fmt.Sprintf("%d аргумента", n)
+	}
+	return fmt.Sprintf("%d аргументов", n)
+}
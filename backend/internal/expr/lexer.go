@@ -0,0 +1,173 @@
+// Package expr разбирает арифметические выражения CalcFlow: лексер делит строку на токены,
+// парсер рекурсивным спуском строит из них дерево (AST), а Eval его вычисляет
+// в float64 или, через Numeric, в целых числах, точных дробях и big.Float.
+// Оркестратор использует пакет для проверки и разбиения выражений, агенты — для вычисления.
+package expr
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TokenKind — вид токена
+type TokenKind int
+
+const (
+	EOF TokenKind = iota
+	Number
+	Operator
+	LParen
+	RParen
+	Name
+	Comma
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case EOF:
+		return "конец выражения"
+	case Number:
+		return "число"
+	case Operator:
+		return "оператор"
+	case LParen:
+		return `"("`
+	case RParen:
+		return `")"`
+	case Name:
+		return "имя"
+	case Comma:
+		return `","`
+	default:
+		return fmt.Sprintf("токен %d", int(k))
+	}
+}
+
+// Position — место в выражении: Offset в байтах с 0, Column в символах с 1
+type Position struct {
+	Offset int
+	Column int
+}
+
+// Token — лексема выражения
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  Position
+}
+
+// describe возвращает токен в виде, понятном пользователю
+func (t Token) describe() string {
+	if t.Kind == EOF {
+		return t.Kind.String()
+	}
+	return fmt.Sprintf("%q", t.Text)
+}
+
+// Lex делит выражение на токены. Пробелы пропускаются, неизвестный символ — ошибка.
+// Последним всегда идёт токен EOF.
+func Lex(input string) ([]Token, error) {
+	var tokens []Token
+	column := 1
+	for offset := 0; offset < len(input); {
+		r, size := utf8.DecodeRuneInString(input[offset:])
+		pos := Position{Offset: offset, Column: column}
+
+		switch {
+		case unicode.IsSpace(r):
+			offset += size
+			column++
+		case isDigit(r):
+			end, width, err := scanNumber(input, offset, column)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, Token{Kind: Number, Text: input[offset:end], Pos: pos})
+			offset = end
+			column += width
+		case isLetter(r):
+			end := offset
+			for end < len(input) && (isLetter(rune(input[end])) || isDigit(rune(input[end]))) {
+				end++
+			}
+			tokens = append(tokens, Token{Kind: Name, Text: input[offset:end], Pos: pos})
+			column += end - offset
+			offset = end
+		case r == '(' || r == ')' || r == ',':
+			kind := LParen
+			if r == ')' {
+				kind = RParen
+			} else if r == ',' {
+				kind = Comma
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: string(r), Pos: pos})
+			offset += size
+			column++
+		default:
+			op := scanOperator(input[offset:])
+			if op == "" {
+				return nil, &SyntaxError{Pos: pos, Message: fmt.Sprintf("неизвестный символ %q", r)}
+			}
+			// Операторы состоят из ASCII символов, поэтому байты совпадают с символами
+			tokens = append(tokens, Token{Kind: Operator, Text: op, Pos: pos})
+			offset += len(op)
+			column += len(op)
+		}
+	}
+	tokens = append(tokens, Token{Kind: EOF, Pos: Position{Offset: len(input), Column: column}})
+	return tokens, nil
+}
+
+// scanNumber читает число вида 12 или 12.5 и возвращает его конец и длину в символах
+func scanNumber(input string, start, column int) (int, int, error) {
+	end := start
+	for end < len(input) && isDigit(rune(input[end])) {
+		end++
+	}
+	if end < len(input) && input[end] == '.' {
+		end++
+		if end >= len(input) || !isDigit(rune(input[end])) {
+			return 0, 0, &SyntaxError{
+				Pos:      Position{Offset: end, Column: column + end - start},
+				Message:  "после десятичной точки нет цифр",
+				Expected: []string{"цифра"},
+			}
+		}
+		for end < len(input) && isDigit(rune(input[end])) {
+			end++
+		}
+	}
+	// Число состоит только из ASCII символов, поэтому байты совпадают с символами
+	return end, end - start, nil
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isLetter сообщает, что r может входить в имя функции или константы.
+// Имена состоят только из ASCII букв, цифр и _, поэтому байты в них совпадают с символами.
+func isLetter(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_'
+}
+
+// scanOperator возвращает самый длинный оператор в начале input, например // вместо /,
+// или пустую строку, если input начинается не с оператора
+func scanOperator(input string) string {
+	for _, length := range []int{2, 1} {
+		if len(input) < length {
+			continue
+		}
+		op := input[:length]
+		if _, ok := binaryOperators[op]; ok {
+			return op
+		}
+		for _, other := range otherOperators {
+			if op == other {
+				return op
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,832 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Mode — арифметика, в которой вычисляется выражение
+type Mode string
+
+const (
+	// ModeFloat64 — числа с плавающей точкой float64, режим по умолчанию
+	ModeFloat64 Mode = "float64"
+	// ModeInt — целые числа произвольной длины (big.Int), деление целочисленное
+	ModeInt Mode = "int"
+	// ModeRat — точные дроби (big.Rat): 1/3 + 1/6 = 1/2
+	ModeRat Mode = "rat"
+	// ModeFloat — числа с плавающей точкой заданной точности (big.Float)
+	ModeFloat Mode = "float"
+)
+
+// Точность big.Float в битах, если она не указана
+const DefaultPrecision = 256
+
+// Самая большая точность big.Float и самый длинный результат степени в битах.
+// Без ограничения одно выражение вроде 9^9^9 заняло бы всю память агента.
+const (
+	MaxPrecision = 1 << 16
+	maxPowerBits = 1 << 20
+)
+
+var errTooLarge = errors.New("результат слишком большой")
+
+// ParseMode разбирает название режима. Пустая строка означает float64.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(s)) {
+	case "", ModeFloat64:
+		return ModeFloat64, nil
+	case ModeInt, "bigint", "big.int":
+		return ModeInt, nil
+	case ModeRat, "bigrat", "big.rat":
+		return ModeRat, nil
+	case ModeFloat, "bigfloat", "big.float":
+		return ModeFloat, nil
+	}
+	return "", fmt.Errorf("неизвестный режим вычислений %q, допустимы float64, int, rat и float", s)
+}
+
+// Numeric — режим вычислений и точность big.Float в битах (для остальных режимов не используется)
+type Numeric struct {
+	Mode      Mode
+	Precision uint
+}
+
+// NewNumeric проверяет режим и точность и возвращает настройки вычислений
+func NewNumeric(mode string, precision uint) (Numeric, error) {
+	m, err := ParseMode(mode)
+	if err != nil {
+		return Numeric{}, err
+	}
+	if precision > MaxPrecision {
+		return Numeric{}, fmt.Errorf("точность не может быть больше %d бит", MaxPrecision)
+	}
+	if m != ModeFloat {
+		precision = 0
+	} else if precision == 0 {
+		precision = DefaultPrecision
+	}
+	return Numeric{Mode: m, Precision: precision}, nil
+}
+
+// Validate проверяет, что все числа, функции и константы выражения допустимы в режиме,
+// например что в режиме int нет дробей, а в режиме rat — числа pi
+func (n Numeric) Validate(tree Node) error {
+	a := n.arithmetic()
+	var err error
+	Inspect(tree, func(node Node) bool {
+		switch node := node.(type) {
+		case *NumberLit:
+			if _, e := a.parse(node.Value); e != nil {
+				err = &SyntaxError{Pos: node.Pos, Message: e.Error()}
+			}
+		case *Ident:
+			if _, ok := constants[node.Name]; ok && !a.supports(node.Name) {
+				err = &SyntaxError{Pos: node.Pos, Message: n.unsupported("константа", node.Name).Error()}
+			}
+		case *Call:
+			if IsFunction(node.Name) && !a.supports(node.Name) {
+				err = &SyntaxError{Pos: node.Pos, Message: n.unsupported("функция", node.Name).Error()}
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+func (n Numeric) unsupported(kind, name string) error {
+	return fmt.Errorf("%s %s недоступна в режиме %s, её нельзя вычислить точно", kind, name, n.Mode)
+}
+
+// Eval вычисляет выражение в режиме n и возвращает результат точной строкой,
+// которую можно снова подставить в выражение: десятичной дробью без экспоненты,
+// а в режиме rat — дробью вида 1/2
+func (n Numeric) Eval(tree Node) (string, error) {
+	return n.EvalWith(tree, Env{})
+}
+
+// Env — переменные и функции пользователя, с которыми вычисляется выражение.
+// Значения переменных — результаты других выражений, например 12 или 1/2.
+// Step, если задан, вызывается перед каждой выполняемой операцией n: op — бинарный оператор,
+// "!", "?:" или имя функции. Операции невыбранной ветки ?: и пропущенного операнда && и ||
+// не выполняются. Ошибка Step прерывает вычисление.
+type Env struct {
+	Vars  map[string]string
+	Funcs map[string]*Definition
+	Step  func(op string, n Node) error
+}
+
+// ValidateWith проверяет выражение, как Validate, а также то, что вызванные функции пользователя
+// из funcs определены и их тела допустимы в режиме
+func (n Numeric) ValidateWith(tree Node, funcs map[string]*Definition) error {
+	if err := n.Validate(tree); err != nil {
+		return err
+	}
+	if err := CheckCalls(tree, funcs); err != nil {
+		return err
+	}
+	for _, def := range UsedFunctions(tree, funcs) {
+		if err := n.Validate(def.Body); err != nil {
+			return definitionError(def, err)
+		}
+	}
+	return nil
+}
+
+// EvalWith вычисляет выражение с переменными и функциями пользователя из env
+func (n Numeric) EvalWith(tree Node, env Env) (string, error) {
+	if err := n.ValidateWith(tree, env.Funcs); err != nil {
+		return "", err
+	}
+	a := n.arithmetic()
+	value, err := evaluator{a: a, env: env}.eval(tree)
+	if err != nil {
+		return "", err
+	}
+	return a.format(value)
+}
+
+func (n Numeric) arithmetic() arithmetic {
+	switch n.Mode {
+	case ModeInt:
+		return intArithmetic{}
+	case ModeRat:
+		return ratArithmetic{}
+	case ModeFloat:
+		prec := n.Precision
+		if prec == 0 {
+			prec = DefaultPrecision
+		}
+		return floatArithmetic{prec: prec}
+	}
+	return float64Arithmetic{}
+}
+
+// arithmetic — операции над числами одного режима.
+// constant и call вызываются только для имён, которые режим поддерживает (supports).
+// Сравнения и логические операторы выражаются через compare, truth и fromBool.
+type arithmetic interface {
+	parse(literal string) (interface{}, error)
+	neg(a interface{}) interface{}
+	binary(op string, a, b interface{}) (interface{}, error)
+	compare(op string, a, b interface{}) bool
+	truth(a interface{}) bool
+	fromBool(b bool) interface{}
+	supports(name string) bool
+	constant(name string) (interface{}, error)
+	call(name string, args []interface{}) (interface{}, error)
+	format(a interface{}) (string, error)
+}
+
+// evaluator вычисляет дерево в арифметике a с переменными и функциями env.
+// Внутри функции пользователя params — значения её параметров, а depth — глубина вызова.
+type evaluator struct {
+	a      arithmetic
+	env    Env
+	params map[string]interface{}
+	depth  int
+}
+
+func (e evaluator) eval(n Node) (interface{}, error) {
+	a := e.a
+	switch n := n.(type) {
+	case *NumberLit:
+		return a.parse(n.Value)
+	case *Ident:
+		if value, ok := e.params[n.Name]; ok {
+			return value, nil
+		}
+		if _, ok := constants[n.Name]; ok {
+			return a.constant(n.Name)
+		}
+		return e.variable(n.Name)
+	case *Assign:
+		return e.eval(n.Value)
+	case *Call:
+		fn, ok := functions[n.Name]
+		if !ok {
+			return e.callDefinition(n)
+		}
+		if len(n.Args) < fn.minArgs || fn.maxArgs >= 0 && len(n.Args) > fn.maxArgs {
+			return nil, fmt.Errorf("функция %s принимает %s, получено %d", n.Name, fn.arity(), len(n.Args))
+		}
+		args := make([]interface{}, len(n.Args))
+		for i, arg := range n.Args {
+			value, err := e.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = value
+		}
+		if err := e.step(n.Name, n); err != nil {
+			return nil, err
+		}
+		return a.call(n.Name, args)
+	case *Unary:
+		operand, err := e.eval(n.Operand)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case "-":
+			return a.neg(operand), nil
+		case "!":
+			if err := e.step("!", n); err != nil {
+				return nil, err
+			}
+			return a.fromBool(!a.truth(operand)), nil
+		}
+		return operand, nil
+	case *Ternary:
+		cond, err := e.eval(n.Cond)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.step("?:", n); err != nil {
+			return nil, err
+		}
+		if a.truth(cond) {
+			return e.eval(n.Then)
+		}
+		return e.eval(n.Else)
+	case *Binary:
+		left, err := e.eval(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		// Логические операторы не вычисляют правый операнд, если результат уже известен
+		if n.Op == "&&" && !a.truth(left) || n.Op == "||" && a.truth(left) {
+			if err := e.step(n.Op, n); err != nil {
+				return nil, err
+			}
+			return a.fromBool(a.truth(left)), nil
+		}
+		right, err := e.eval(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.step(n.Op, n); err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case "&&", "||":
+			return a.fromBool(a.truth(right)), nil
+		case "==", "!=", "<", "<=", ">", ">=":
+			return a.fromBool(a.compare(n.Op, left, right)), nil
+		}
+		return a.binary(n.Op, left, right)
+	}
+	return nil, fmt.Errorf("неподдерживаемый узел %T", n)
+}
+
+// callDefinition вычисляет вызов функции пользователя: аргументы — в текущем окружении,
+// тело — только с параметрами
+func (e evaluator) callDefinition(n *Call) (interface{}, error) {
+	def, ok := e.env.Funcs[n.Name]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная функция %q", n.Name)
+	}
+	if len(n.Args) != len(def.Params) {
+		return nil, fmt.Errorf("функция %s принимает %s, получено %d", n.Name, arguments(len(def.Params)), len(n.Args))
+	}
+	if e.depth >= MaxCallDepth {
+		return nil, fmt.Errorf("цепочка вызовов функций длиннее %d", MaxCallDepth)
+	}
+
+	params := make(map[string]interface{}, len(def.Params))
+	for i, arg := range n.Args {
+		value, err := e.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		params[def.Params[i]] = value
+	}
+	if err := e.step(n.Name, n); err != nil {
+		return nil, err
+	}
+	body := evaluator{a: e.a, env: Env{Funcs: e.env.Funcs, Step: e.env.Step}, params: params, depth: e.depth + 1}
+	return body.eval(def.Body)
+}
+
+// step сообщает окружению о выполняемой операции
+func (e evaluator) step(op string, n Node) error {
+	if e.env.Step == nil {
+		return nil
+	}
+	return e.env.Step(op, n)
+}
+
+// variable вычисляет значение переменной. Значение само разбирается как выражение,
+// поэтому дробь 1/2 из режима rat подставляется и в float64.
+func (e evaluator) variable(name string) (interface{}, error) {
+	value, ok := e.env.Vars[name]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная переменная %q", name)
+	}
+	// Дробь из режима rat в режиме int поделилась бы нацело
+	if _, ok := e.a.(intArithmetic); ok && strings.Contains(value, "/") {
+		return nil, fmt.Errorf("значение переменной %s = %s не целое, в режиме int допустимы только целые числа", name, value)
+	}
+	tree, err := Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("значение переменной %s: %v", name, err)
+	}
+	result, err := evaluator{a: e.a}.eval(tree)
+	if err != nil {
+		return nil, fmt.Errorf("значение переменной %s: %v", name, err)
+	}
+	return result, nil
+}
+
+type float64Arithmetic struct{}
+
+func (float64Arithmetic) parse(literal string) (interface{}, error) {
+	value, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка преобразования числа: %v", err)
+	}
+	return value, nil
+}
+
+func (float64Arithmetic) neg(a interface{}) interface{} {
+	return -a.(float64)
+}
+
+func (float64Arithmetic) binary(op string, a, b interface{}) (interface{}, error) {
+	return evalBinary(op, a.(float64), b.(float64))
+}
+
+func (float64Arithmetic) compare(op string, a, b interface{}) bool {
+	x, y := a.(float64), b.(float64)
+	switch op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	}
+	return x >= y
+}
+
+func (float64Arithmetic) truth(a interface{}) bool {
+	return a.(float64) != 0
+}
+
+func (float64Arithmetic) fromBool(b bool) interface{} {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+func (float64Arithmetic) supports(name string) bool {
+	return true
+}
+
+func (f float64Arithmetic) constant(name string) (interface{}, error) {
+	return f.parse(constants[name])
+}
+
+func (float64Arithmetic) call(name string, args []interface{}) (interface{}, error) {
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		values[i] = arg.(float64)
+	}
+	return functions[name].float64(values)
+}
+
+func (float64Arithmetic) format(a interface{}) (string, error) {
+	value := a.(float64)
+	// Бесконечность и NaN нельзя передать дальше как число
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return "", fmt.Errorf("результат %v не является конечным числом", value)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), nil
+}
+
+type intArithmetic struct{}
+
+func (intArithmetic) parse(literal string) (interface{}, error) {
+	value, ok := new(big.Int).SetString(literal, 10)
+	if !ok {
+		return nil, fmt.Errorf("в режиме int допустимы только целые числа, получено %s", literal)
+	}
+	return value, nil
+}
+
+func (intArithmetic) neg(a interface{}) interface{} {
+	return new(big.Int).Neg(a.(*big.Int))
+}
+
+func (intArithmetic) binary(op string, a, b interface{}) (interface{}, error) {
+	x, y := a.(*big.Int), b.(*big.Int)
+	switch op {
+	case "+":
+		return new(big.Int).Add(x, y), nil
+	case "-":
+		return new(big.Int).Sub(x, y), nil
+	case "*":
+		return new(big.Int).Mul(x, y), nil
+	case "/":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		// Деление целочисленное, с отбрасыванием дробной части
+		return new(big.Int).Quo(x, y), nil
+	case "//", "%":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		// // округляет вниз, а остаток имеет знак делителя: a == (a//b)*b + a%b
+		quo, rem := new(big.Int).QuoRem(x, y, new(big.Int))
+		if rem.Sign() != 0 && (rem.Sign() < 0) != (y.Sign() < 0) {
+			quo.Sub(quo, big.NewInt(1))
+			rem.Add(rem, y)
+		}
+		if op == "//" {
+			return quo, nil
+		}
+		return rem, nil
+	case "^":
+		if y.Sign() < 0 {
+			return nil, fmt.Errorf("в режиме int показатель степени не может быть отрицательным")
+		}
+		if err := checkPower(x.BitLen(), y); err != nil {
+			return nil, err
+		}
+		return new(big.Int).Exp(x, y, nil), nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый оператор %q", op)
+}
+
+func (intArithmetic) compare(op string, a, b interface{}) bool {
+	return compareResult(op, a.(*big.Int).Cmp(b.(*big.Int)))
+}
+
+func (intArithmetic) truth(a interface{}) bool {
+	return a.(*big.Int).Sign() != 0
+}
+
+func (intArithmetic) fromBool(b bool) interface{} {
+	if b {
+		return big.NewInt(1)
+	}
+	return big.NewInt(0)
+}
+
+func (intArithmetic) supports(name string) bool {
+	return exactFunctions[name]
+}
+
+func (intArithmetic) constant(name string) (interface{}, error) {
+	return nil, fmt.Errorf("константа %s недоступна в режиме int", name)
+}
+
+func (intArithmetic) call(name string, args []interface{}) (interface{}, error) {
+	x := args[0].(*big.Int)
+	switch name {
+	case "abs":
+		return new(big.Int).Abs(x), nil
+	case "min", "max":
+		return extremum(name, args, func(a, b interface{}) int { return a.(*big.Int).Cmp(b.(*big.Int)) }), nil
+	case "floor", "ceil", "round":
+		return x, nil
+	case "sqrt":
+		if x.Sign() < 0 {
+			return nil, errNegativeSqrt
+		}
+		// Как и деление, корень в режиме int целочисленный
+		return new(big.Int).Sqrt(x), nil
+	}
+	return nil, fmt.Errorf("функция %s недоступна в режиме int", name)
+}
+
+func (intArithmetic) format(a interface{}) (string, error) {
+	return a.(*big.Int).String(), nil
+}
+
+type ratArithmetic struct{}
+
+func (ratArithmetic) parse(literal string) (interface{}, error) {
+	value, ok := new(big.Rat).SetString(literal)
+	if !ok {
+		return nil, fmt.Errorf("ошибка преобразования числа %s", literal)
+	}
+	return value, nil
+}
+
+func (ratArithmetic) neg(a interface{}) interface{} {
+	return new(big.Rat).Neg(a.(*big.Rat))
+}
+
+func (ratArithmetic) binary(op string, a, b interface{}) (interface{}, error) {
+	x, y := a.(*big.Rat), b.(*big.Rat)
+	switch op {
+	case "+":
+		return new(big.Rat).Add(x, y), nil
+	case "-":
+		return new(big.Rat).Sub(x, y), nil
+	case "*":
+		return new(big.Rat).Mul(x, y), nil
+	case "/":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return new(big.Rat).Quo(x, y), nil
+	case "//", "%":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		quo := new(big.Rat).SetInt(ratFloor(new(big.Rat).Quo(x, y)))
+		if op == "//" {
+			return quo, nil
+		}
+		return new(big.Rat).Sub(x, quo.Mul(quo, y)), nil
+	case "^":
+		if !y.IsInt() {
+			return nil, fmt.Errorf("в режиме rat показатель степени должен быть целым")
+		}
+		exp := y.Num()
+		if x.Sign() == 0 && exp.Sign() < 0 {
+			return nil, ErrDivisionByZero
+		}
+		abs := new(big.Int).Abs(exp)
+		bits := x.Num().BitLen()
+		if d := x.Denom().BitLen(); d > bits {
+			bits = d
+		}
+		if err := checkPower(bits, abs); err != nil {
+			return nil, err
+		}
+		num := new(big.Int).Exp(x.Num(), abs, nil)
+		den := new(big.Int).Exp(x.Denom(), abs, nil)
+		if exp.Sign() < 0 {
+			num, den = den, num
+		}
+		return new(big.Rat).SetFrac(num, den), nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый оператор %q", op)
+}
+
+func (ratArithmetic) compare(op string, a, b interface{}) bool {
+	return compareResult(op, a.(*big.Rat).Cmp(b.(*big.Rat)))
+}
+
+func (ratArithmetic) truth(a interface{}) bool {
+	return a.(*big.Rat).Sign() != 0
+}
+
+func (ratArithmetic) fromBool(b bool) interface{} {
+	if b {
+		return big.NewRat(1, 1)
+	}
+	return new(big.Rat)
+}
+
+func (ratArithmetic) supports(name string) bool {
+	return exactFunctions[name]
+}
+
+func (ratArithmetic) constant(name string) (interface{}, error) {
+	return nil, fmt.Errorf("константа %s недоступна в режиме rat", name)
+}
+
+func (ratArithmetic) call(name string, args []interface{}) (interface{}, error) {
+	x := args[0].(*big.Rat)
+	switch name {
+	case "abs":
+		return new(big.Rat).Abs(x), nil
+	case "min", "max":
+		return extremum(name, args, func(a, b interface{}) int { return a.(*big.Rat).Cmp(b.(*big.Rat)) }), nil
+	case "floor":
+		return new(big.Rat).SetInt(ratFloor(x)), nil
+	case "ceil":
+		return new(big.Rat).SetInt(new(big.Int).Neg(ratFloor(new(big.Rat).Neg(x)))), nil
+	case "round":
+		// Половина округляется от нуля, как math.Round
+		half := new(big.Rat).Add(new(big.Rat).Abs(x), big.NewRat(1, 2))
+		rounded := ratFloor(half)
+		if x.Sign() < 0 {
+			rounded.Neg(rounded)
+		}
+		return new(big.Rat).SetInt(rounded), nil
+	case "sqrt":
+		if x.Sign() < 0 {
+			return nil, errNegativeSqrt
+		}
+		num, den := new(big.Int).Sqrt(x.Num()), new(big.Int).Sqrt(x.Denom())
+		if new(big.Int).Mul(num, num).Cmp(x.Num()) != 0 || new(big.Int).Mul(den, den).Cmp(x.Denom()) != 0 {
+			return nil, fmt.Errorf("корень из %s не является рациональным числом", x.RatString())
+		}
+		return new(big.Rat).SetFrac(num, den), nil
+	}
+	return nil, fmt.Errorf("функция %s недоступна в режиме rat", name)
+}
+
+// ratFloor округляет дробь вниз. Знаменатель дроби всегда положителен,
+// поэтому евклидово деление big.Int совпадает с округлением вниз.
+func ratFloor(x *big.Rat) *big.Int {
+	return new(big.Int).Div(x.Num(), x.Denom())
+}
+
+func (ratArithmetic) format(a interface{}) (string, error) {
+	return a.(*big.Rat).RatString(), nil
+}
+
+type floatArithmetic struct {
+	prec uint
+}
+
+func (f floatArithmetic) parse(literal string) (interface{}, error) {
+	value, _, err := big.ParseFloat(literal, 10, f.prec, big.ToNearestEven)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка преобразования числа: %v", err)
+	}
+	return value, nil
+}
+
+func (f floatArithmetic) neg(a interface{}) interface{} {
+	return new(big.Float).SetPrec(f.prec).Neg(a.(*big.Float))
+}
+
+func (f floatArithmetic) binary(op string, a, b interface{}) (interface{}, error) {
+	x, y := a.(*big.Float), b.(*big.Float)
+	z := new(big.Float).SetPrec(f.prec)
+	switch op {
+	case "+":
+		return z.Add(x, y), nil
+	case "-":
+		return z.Sub(x, y), nil
+	case "*":
+		return z.Mul(x, y), nil
+	case "/":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return z.Quo(x, y), nil
+	case "//", "%":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		quo := f.floor(z.Quo(x, y))
+		if op == "//" {
+			return quo, nil
+		}
+		return new(big.Float).SetPrec(f.prec).Sub(x, quo.Mul(quo, y)), nil
+	case "^":
+		if !y.IsInt() {
+			return nil, fmt.Errorf("в режиме float показатель степени должен быть целым")
+		}
+		exp, _ := y.Int(nil)
+		if x.Sign() == 0 && exp.Sign() < 0 {
+			return nil, ErrDivisionByZero
+		}
+		abs := new(big.Int).Abs(exp)
+		if err := checkPower(x.MantExp(nil), abs); err != nil {
+			return nil, err
+		}
+		// Возведение в степень последовательным возведением в квадрат
+		result := new(big.Float).SetPrec(f.prec).SetInt64(1)
+		base := new(big.Float).SetPrec(f.prec).Set(x)
+		for i := 0; i < abs.BitLen(); i++ {
+			if abs.Bit(i) == 1 {
+				result.Mul(result, base)
+			}
+			base.Mul(base, base)
+		}
+		if exp.Sign() < 0 {
+			result.Quo(new(big.Float).SetPrec(f.prec).SetInt64(1), result)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый оператор %q", op)
+}
+
+func (floatArithmetic) compare(op string, a, b interface{}) bool {
+	return compareResult(op, a.(*big.Float).Cmp(b.(*big.Float)))
+}
+
+func (floatArithmetic) truth(a interface{}) bool {
+	return a.(*big.Float).Sign() != 0
+}
+
+func (f floatArithmetic) fromBool(b bool) interface{} {
+	if b {
+		return new(big.Float).SetPrec(f.prec).SetInt64(1)
+	}
+	return new(big.Float).SetPrec(f.prec)
+}
+
+func (floatArithmetic) supports(name string) bool {
+	_, constant := constants[name]
+	return constant || exactFunctions[name]
+}
+
+func (f floatArithmetic) constant(name string) (interface{}, error) {
+	return f.parse(constants[name])
+}
+
+func (f floatArithmetic) call(name string, args []interface{}) (interface{}, error) {
+	x := args[0].(*big.Float)
+	z := new(big.Float).SetPrec(f.prec)
+	switch name {
+	case "abs":
+		return z.Abs(x), nil
+	case "min", "max":
+		return extremum(name, args, func(a, b interface{}) int { return a.(*big.Float).Cmp(b.(*big.Float)) }), nil
+	case "floor":
+		return f.floor(x), nil
+	case "ceil":
+		return z.Neg(f.floor(new(big.Float).Neg(x))), nil
+	case "round":
+		// Половина округляется от нуля, как math.Round
+		half := new(big.Float).SetPrec(f.prec).Abs(x)
+		half.Add(half, big.NewFloat(0.5))
+		rounded := f.floor(half)
+		if x.Sign() < 0 {
+			rounded.Neg(rounded)
+		}
+		return rounded, nil
+	case "sqrt":
+		if x.Sign() < 0 {
+			return nil, errNegativeSqrt
+		}
+		return z.Sqrt(x), nil
+	}
+	return nil, fmt.Errorf("функция %s недоступна в режиме float", name)
+}
+
+// floor округляет число вниз
+func (f floatArithmetic) floor(x *big.Float) *big.Float {
+	if x.IsInt() {
+		return new(big.Float).SetPrec(f.prec).Set(x)
+	}
+	// Int отбрасывает дробную часть, то есть округляет к нулю
+	truncated, _ := x.Int(nil)
+	if x.Sign() < 0 {
+		truncated.Sub(truncated, big.NewInt(1))
+	}
+	return new(big.Float).SetPrec(f.prec).SetInt(truncated)
+}
+
+func (floatArithmetic) format(a interface{}) (string, error) {
+	value := a.(*big.Float)
+	if value.IsInf() {
+		return "", fmt.Errorf("результат %v не является конечным числом", value)
+	}
+	return value.Text('f', -1), nil
+}
+
+// compareResult переводит результат Cmp (-1, 0 или 1) в результат сравнения op
+func compareResult(op string, c int) bool {
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// extremum возвращает наименьший (min) или наибольший (max) из аргументов
+func extremum(name string, args []interface{}, cmp func(a, b interface{}) int) interface{} {
+	result := args[0]
+	for _, arg := range args[1:] {
+		c := cmp(arg, result)
+		if name == "min" && c < 0 || name == "max" && c > 0 {
+			result = arg
+		}
+	}
+	return result
+}
+
+// checkPower не даёт возвести в степень, результат которой займёт больше maxPowerBits бит
+func checkPower(baseBits int, exp *big.Int) error {
+	if baseBits < 0 {
+		baseBits = -baseBits
+	}
+	if baseBits <= 1 {
+		// Основание 0, 1 или -1 не растёт, а дробь по модулю меньше единицы ограничена точностью
+		return nil
+	}
+	// Делим, а не умножаем: произведение большого показателя на число бит переполнит int64
+	if !exp.IsInt64() || exp.Int64() > maxPowerBits/int64(baseBits) {
+		return errTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package expr
+
+import "fmt"
+
+// Associativity — порядок, в котором группируются операторы одного приоритета
+type Associativity int
+
+const (
+	LeftAssoc Associativity = iota
+	RightAssoc
+)
+
+// operator — приоритет и ассоциативность бинарного оператора
+type operator struct {
+	precedence int
+	assoc      Associativity
+}
+
+// Таблица бинарных операторов. Чем больше приоритет, тем сильнее оператор связывает операнды.
+// Сравнения и логические операторы возвращают 1 (истина) или 0 (ложь), истинно любое ненулевое число.
+var binaryOperators = map[string]operator{
+	"||": {precedence: 1, assoc: LeftAssoc},
+	"&&": {precedence: 2, assoc: LeftAssoc},
+	"==": {precedence: 3, assoc: LeftAssoc},
+	"!=": {precedence: 3, assoc: LeftAssoc},
+	"<":  {precedence: 4, assoc: LeftAssoc},
+	"<=": {precedence: 4, assoc: LeftAssoc},
+	">":  {precedence: 4, assoc: LeftAssoc},
+	">=": {precedence: 4, assoc: LeftAssoc},
+	"+":  {precedence: 5, assoc: LeftAssoc},
+	"-":  {precedence: 5, assoc: LeftAssoc},
+	"*":  {precedence: 6, assoc: LeftAssoc},
+	"/":  {precedence: 6, assoc: LeftAssoc},
+	"%":  {precedence: 6, assoc: LeftAssoc},
+	"//": {precedence: 6, assoc: LeftAssoc},
+	"^":  {precedence: 7, assoc: RightAssoc}, // 2^3^2 = 2^(3^2)
+}
+
+// Операторы, которые не входят в таблицу бинарных: логическое отрицание, части условного оператора
+// и присваивание
+var otherOperators = []string{"!", "?", ":", "="}
+
+// Операнд унарного плюса, минуса или отрицания разбирается с приоритетом степени,
+// поэтому -2^2 = -(2^2), а 2^-2 = 2^(-2)
+const unaryPrecedence = 7
+
+// Неявное умножение, например 2(3+4) или (1+2)(3+4), работает как обычное *
+const implicitOperator = "*"
+
+// Грамматика:
+//
+//	input      = [ name "=" | name "(" name { "," name } ")" "=" ] ternary
+//	ternary    = expression [ "?" ternary ":" ternary ]
+//	expression = unary { operator unary | group }   (с учётом приоритетов из binaryOperators)
+//	unary      = ( "+" | "-" | "!" ) unary | primary
+//	primary    = number | name | call | group
+//	call       = name "(" ternary { "," ternary } ")"
+//	group      = "(" ternary ")"
+//
+// Скобка сразу после числа или скобки, как и число, константа или функция после скобки
+// или числа, означает умножение: 2(3+4), 2pi, 3sqrt(2).
+type parser struct {
+	tokens []Token
+	pos    int
+}
+
+// Parse разбирает выражение в дерево. Ошибки разбора имеют тип *SyntaxError.
+// Присваивание x = 3*4 разбирается в узел *Assign, определение функции f(x, y) = x*y — в *Definition.
+// Имена без скобок, кроме констант, — переменные или параметры, а вызовы неизвестных функций
+// проверяются по функциям пользователя (CheckCalls).
+func Parse(input string) (Node, error) {
+	tokens, err := Lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().Kind == EOF {
+		return nil, &SyntaxError{Pos: p.peek().Pos, Message: "пустое выражение"}
+	}
+
+	assign, err := p.parseAssignment()
+	if err != nil {
+		return nil, err
+	}
+	def, err := p.parseDefinition()
+	if err != nil {
+		return nil, err
+	}
+	// Присваивание и определение не сочетаются: x = f(a) = 2 не может ни сохранить, ни вычислить функцию
+	if assign != nil && def != nil {
+		return nil, &SyntaxError{Pos: def.Pos, Message: fmt.Sprintf("переменной %s нельзя присвоить определение функции %s", assign.Name, def.Name)}
+	}
+	n, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Всё выражение должно быть разобрано
+	if tok := p.peek(); tok.Kind != EOF {
+		if tok.Kind == RParen {
+			return nil, &SyntaxError{Pos: tok.Pos, Message: "лишняя закрывающая скобка"}
+		}
+		return nil, &SyntaxError{Pos: tok.Pos, Expected: []string{"оператор"}, Found: tok.describe()}
+	}
+	if assign != nil {
+		assign.Value = n
+		return assign, nil
+	}
+	if def != nil {
+		def.Body = n
+		return def, nil
+	}
+	return n, nil
+}
+
+// parseAssignment разбирает начало присваивания name = и возвращает nil, если выражение им не начинается.
+// Имена функций и констант заняты.
+func (p *parser) parseAssignment() (*Assign, error) {
+	name := p.peek()
+	if name.Kind != Name || p.tokens[p.pos+1].Kind != Operator || p.tokens[p.pos+1].Text != "=" {
+		return nil, nil
+	}
+	if err := checkName(name, "нельзя присвоить значение константе %s"); err != nil {
+		return nil, err
+	}
+	p.next()
+	p.next()
+	if p.peek().Kind == EOF {
+		return nil, &SyntaxError{Pos: p.peek().Pos, Message: fmt.Sprintf("не указано значение переменной %s", name.Text)}
+	}
+	return &Assign{Name: name.Text, Pos: name.Pos}, nil
+}
+
+// parseDefinition разбирает начало определения функции f(x, y) = и возвращает nil,
+// если выражение им не начинается, например если это вызов f(2) + 1
+func (p *parser) parseDefinition() (*Definition, error) {
+	if !p.definitionAhead() {
+		return nil, nil
+	}
+	name := p.next()
+	if err := checkName(name, "имя %s занято константой"); err != nil {
+		return nil, err
+	}
+	p.next()
+
+	def := &Definition{Name: name.Text, Pos: name.Pos}
+	seen := make(map[string]bool)
+	for {
+		param := p.next()
+		if err := checkName(param, "имя %s занято константой"); err != nil {
+			return nil, err
+		}
+		if seen[param.Text] {
+			return nil, &SyntaxError{Pos: param.Pos, Message: fmt.Sprintf("параметр %s повторяется", param.Text)}
+		}
+		seen[param.Text] = true
+		def.Params = append(def.Params, param.Text)
+		if p.next().Kind == RParen {
+			break
+		}
+	}
+	p.next()
+	if p.peek().Kind == EOF {
+		return nil, &SyntaxError{Pos: p.peek().Pos, Message: fmt.Sprintf("не указано тело функции %s", name.Text)}
+	}
+	return def, nil
+}
+
+// definitionAhead сообщает, что выражение начинается с name ( name { , name } ) =
+func (p *parser) definitionAhead() bool {
+	tokens := p.tokens[p.pos:]
+	if len(tokens) < 5 || tokens[0].Kind != Name || tokens[1].Kind != LParen {
+		return false
+	}
+	for i := 2; i+2 < len(tokens); i += 2 {
+		if tokens[i].Kind != Name {
+			return false
+		}
+		switch tokens[i+1].Kind {
+		case Comma:
+			continue
+		case RParen:
+			return tokens[i+2].Kind == Operator && tokens[i+2].Text == "="
+		}
+		return false
+	}
+	return false
+}
+
+// checkName проверяет, что имя переменной, функции или параметра не занято константой или встроенной функцией
+func checkName(name Token, constantMessage string) error {
+	if _, ok := constants[name.Text]; ok {
+		return &SyntaxError{Pos: name.Pos, Message: fmt.Sprintf(constantMessage, name.Text)}
+	}
+	if IsFunction(name.Text) {
+		return &SyntaxError{Pos: name.Pos, Message: fmt.Sprintf("имя %s занято встроенной функцией", name.Text)}
+	}
+	return nil
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != EOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseTernary разбирает условный оператор cond ? a : b. Он слабее всех бинарных операторов
+// и правоассоциативен: a ? b : c ? d : e = a ? b : (c ? d : e)
+func (p *parser) parseTernary() (Node, error) {
+	cond, err := p.parseExpression(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != Operator || tok.Text != "?" {
+		return cond, nil
+	}
+	question := p.next()
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.next(); tok.Kind != Operator || tok.Text != ":" {
+		return nil, &SyntaxError{Pos: tok.Pos, Expected: []string{"оператор", `":"`}, Found: tok.describe()}
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &Ternary{Cond: cond, Then: then, Else: otherwise, Pos: question.Pos}, nil
+}
+
+// parseExpression разбирает операции с приоритетом не ниже minPrecedence
+func (p *parser) parseExpression(minPrecedence int) (Node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		opText := tok.Text
+		switch {
+		case tok.Kind == Operator:
+		case p.implicitMultiplication():
+			opText = implicitOperator
+		default:
+			return left, nil
+		}
+		// У ? и : нет приоритета, они завершают бинарное выражение
+		op := binaryOperators[opText]
+		if op.precedence < minPrecedence {
+			return left, nil
+		}
+		if tok.Kind == Operator {
+			p.next()
+		}
+
+		// Правый операнд левоассоциативного оператора не может содержать операторы
+		// того же приоритета, а правоассоциативного — может
+		next := op.precedence + 1
+		if op.assoc == RightAssoc {
+			next = op.precedence
+		}
+		right, err := p.parseExpression(next)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: opText, Left: left, Right: right, Pos: tok.Pos}
+	}
+}
+
+// implicitMultiplication сообщает, что следующий токен начинает множитель без знака *:
+// скобка после числа или скобки, число после скобки либо имя после числа или скобки
+func (p *parser) implicitMultiplication() bool {
+	if p.pos == 0 {
+		return false
+	}
+	prev, tok := p.tokens[p.pos-1], p.peek()
+	switch tok.Kind {
+	case LParen:
+		return prev.Kind == Number || prev.Kind == RParen
+	case Number:
+		return prev.Kind == RParen
+	case Name:
+		return prev.Kind == Number || prev.Kind == RParen
+	}
+	return false
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch {
+	case tok.Kind == Number:
+		return &NumberLit{Value: tok.Text, Pos: tok.Pos}, nil
+	case tok.Kind == Name && p.peek().Kind == LParen:
+		return p.parseCall(tok)
+	case tok.Kind == Name:
+		return &Ident{Name: tok.Text, Pos: tok.Pos}, nil
+	case tok.Kind == Operator && (tok.Text == "-" || tok.Text == "+" || tok.Text == "!"):
+		operand, err := p.parseExpression(unaryPrecedence)
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Op: tok.Text, Operand: operand, Pos: tok.Pos}, nil
+	case tok.Kind == LParen:
+		inner, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.Kind != RParen {
+			err := &SyntaxError{Pos: closing.Pos, Expected: []string{"оператор", RParen.String()}, Found: closing.describe()}
+			if closing.Kind == EOF {
+				err.Message = fmt.Sprintf("не закрыта скобка из позиции %d", tok.Pos.Column)
+			}
+			return nil, err
+		}
+		return inner, nil
+	default:
+		return nil, &SyntaxError{Pos: tok.Pos, Expected: []string{Number.String(), Name.String(), LParen.String(), "унарный оператор"}, Found: tok.describe()}
+	}
+}
+
+// parseCall разбирает аргументы функции name и проверяет их число у встроенных функций.
+// Функции пользователя проверяет CheckCalls.
+func (p *parser) parseCall(name Token) (Node, error) {
+	open := p.next()
+
+	var args []Node
+	for {
+		arg, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		tok := p.next()
+		if tok.Kind == Comma {
+			continue
+		}
+		if tok.Kind == RParen {
+			break
+		}
+		syntaxErr := &SyntaxError{Pos: tok.Pos, Expected: []string{"оператор", Comma.String(), RParen.String()}, Found: tok.describe()}
+		if tok.Kind == EOF {
+			syntaxErr.Message = fmt.Sprintf("не закрыта скобка из позиции %d", open.Pos.Column)
+		}
+		return nil, syntaxErr
+	}
+
+	if fn, ok := functions[name.Text]; ok && (len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, &SyntaxError{Pos: name.Pos, Message: fmt.Sprintf("функция %s принимает %s, получено %d", name.Text, fn.arity(), len(args))}
+	}
+	return &Call{Name: name.Text, Args: args, Pos: name.Pos}, nil
+}
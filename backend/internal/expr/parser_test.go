@@ -0,0 +1,164 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Унарный минус и неявное умножение относительно степени: дерево разбора и значение при x = 3
+func TestParseUnaryAndImplicitPower(t *testing.T) {
+	cases := []struct {
+		expression string
+		tree       string
+		want       string
+	}{
+		{expression: "-2^2", tree: "(-(2^2))", want: "-4"},
+		{expression: "2^-1", tree: "(2^(-1))", want: "0.5"},
+		{expression: "2(3)^2", tree: "(2*(3^2))", want: "18"},
+		{expression: "2x^2", tree: "(2*(x^2))", want: "18"},
+		{expression: "-2^-2", tree: "(-(2^(-2)))", want: "-0.25"},
+		{expression: "(-2)^2", tree: "((-2)^2)", want: "4"},
+		{expression: "2^2(3)", tree: "((2^2)*3)", want: "12"},
+		{expression: "-x^2", tree: "(-(x^2))", want: "-9"},
+		{expression: "(1+2)(3+4)", tree: "((1+2)*(3+4))", want: "21"},
+	}
+
+	numeric, err := NewNumeric(string(ModeFloat64), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Env{Vars: map[string]string{"x": "3"}}
+	for _, c := range cases {
+		tree, err := Parse(c.expression)
+		if err != nil {
+			t.Errorf("%s: ошибка разбора: %v", c.expression, err)
+			continue
+		}
+		if got := tree.String(); got != c.tree {
+			t.Errorf("%s: дерево %s, ожидалось %s", c.expression, got, c.tree)
+		}
+		got, err := numeric.EvalWith(tree, env)
+		if err != nil {
+			t.Errorf("%s: ошибка вычисления: %v", c.expression, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s = %s, ожидалось %s", c.expression, got, c.want)
+		}
+	}
+}
+
+// Приоритет и ассоциативность операторов и неявное умножение: дерево разбора
+func TestParsePrecedence(t *testing.T) {
+	cases := []struct {
+		expression string
+		tree       string
+	}{
+		{expression: "1+2*3", tree: "(1+(2*3))"},
+		{expression: "1*2+3", tree: "((1*2)+3)"},
+		{expression: "2*3^2", tree: "(2*(3^2))"},
+		{expression: "2^3^2", tree: "(2^(3^2))"},
+		{expression: "8/2/2", tree: "((8/2)/2)"},
+		{expression: "7-3-2", tree: "((7-3)-2)"},
+		{expression: "7//2*2", tree: "((7//2)*2)"},
+		{expression: "-7%2", tree: "((-7)%2)"},
+		{expression: "1 < 2 == 1", tree: "((1<2)==1)"},
+		{expression: "1 || 0 && 0", tree: "(1||(0&&0))"},
+		{expression: "1 ? 2 : 3 ? 4 : 5", tree: "(1?2:(3?4:5))"},
+		{expression: "2x", tree: "(2*x)"},
+		{expression: "2sqrt(4)", tree: "(2*sqrt(4))"},
+		{expression: "2(1+1)x", tree: "((2*(1+1))*x)"},
+		{expression: "x = 2+3", tree: "x=(2+3)"},
+	}
+
+	for _, c := range cases {
+		tree, err := Parse(c.expression)
+		if err != nil {
+			t.Errorf("%s: ошибка разбора: %v", c.expression, err)
+			continue
+		}
+		if got := tree.String(); got != c.tree {
+			t.Errorf("%s: дерево %s, ожидалось %s", c.expression, got, c.tree)
+		}
+	}
+}
+
+// Синтаксическая ошибка указывает позицию, что там ожидалось и что найдено
+func TestParseErrors(t *testing.T) {
+	operand := []string{"число", "имя", `"("`, "унарный оператор"}
+	cases := []struct {
+		expression string
+		column     int
+		expected   []string
+		found      string
+		message    string
+	}{
+		{
+			expression: "2+",
+			column:     3,
+			expected:   operand,
+			found:      "конец выражения",
+			message:    `синтаксическая ошибка в позиции 3: ожидалось число или имя или "(" или унарный оператор, получено конец выражения`,
+		},
+		{
+			expression: "(1",
+			column:     3,
+			expected:   []string{"оператор", `")"`},
+			found:      "конец выражения",
+			message:    `синтаксическая ошибка в позиции 3: не закрыта скобка из позиции 1, ожидалось оператор или ")", получено конец выражения`,
+		},
+		{
+			expression: "2**3",
+			column:     3,
+			expected:   operand,
+			found:      `"*"`,
+			message:    `синтаксическая ошибка в позиции 3: ожидалось число или имя или "(" или унарный оператор, получено "*"`,
+		},
+		{
+			expression: "1 2",
+			column:     3,
+			expected:   []string{"оператор"},
+			found:      `"2"`,
+			message:    `синтаксическая ошибка в позиции 3: ожидалось оператор, получено "2"`,
+		},
+		{
+			expression: "1)",
+			column:     2,
+			message:    "синтаксическая ошибка в позиции 2: лишняя закрывающая скобка",
+		},
+		{
+			expression: "",
+			column:     1,
+			message:    "синтаксическая ошибка в позиции 1: пустое выражение",
+		},
+		{
+			expression: "x = f(a) = 2",
+			column:     5,
+			message:    "синтаксическая ошибка в позиции 5: переменной x нельзя присвоить определение функции f",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := Parse(c.expression)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: ошибка %v, ожидалась синтаксическая", c.expression, err)
+			continue
+		}
+		if syntaxErr.Pos.Column != c.column {
+			t.Errorf("%q: позиция %d, ожидалась %d", c.expression, syntaxErr.Pos.Column, c.column)
+		}
+		if len(syntaxErr.Expected) != 0 || len(c.expected) != 0 {
+			if !reflect.DeepEqual(syntaxErr.Expected, c.expected) {
+				t.Errorf("%q: ожидалось %q, в ошибке %q", c.expression, c.expected, syntaxErr.Expected)
+			}
+		}
+		if syntaxErr.Found != c.found {
+			t.Errorf("%q: получено %q, в ошибке %q", c.expression, c.found, syntaxErr.Found)
+		}
+		if got := err.Error(); got != c.message {
+			t.Errorf("%q: сообщение %q, ожидалось %q", c.expression, got, c.message)
+		}
+	}
+}
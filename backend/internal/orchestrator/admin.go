@@ -0,0 +1,193 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// Администрирование: все агенты и очереди задач по пулам. Администратор сервера видит всё,
+// администратор организации — агентов и очередь своих организаций.
+
+// adminAgent — агент вместе с владельцем и организацией
+type adminAgent struct {
+	apiAgent
+	User  string `json:"user"`
+	OrgID int    `json:"org_id,omitempty"`
+	Org   string `json:"org,omitempty"`
+}
+
+// poolQueue — очередь задач одного пула: организации или личных агентов пользователя
+type poolQueue struct {
+	OrgID int    `json:"org_id,omitempty"`
+	Org   string `json:"org,omitempty"`
+	User  string `json:"user,omitempty"`
+	// Задачи, ждущие агента, выданные агентам и ждущие результатов других задач
+	Queued  int `json:"queued"`
+	Leased  int `json:"leased"`
+	Waiting int `json:"waiting"`
+}
+
+// canAdminister сообщает, может ли пользователь открыть администрирование
+func canAdminister(user string) (bool, error) {
+	if isSystemAdmin(user) {
+		return true, nil
+	}
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM memberships WHERE user = ? AND role = ?", user, RoleAdmin).Scan(&n)
+	return n > 0, err
+}
+
+// getAdminAgents возвращает агентов, которых видит администратор user
+func getAdminAgents(user string) ([]adminAgent, error) {
+	rows, err := db.Query(`SELECT a.id, COALESCE(a.name, ''), a.status, a.last_ping, a.capacity, a.load, a.user,
+			COALESCE(a.org_id, 0), COALESCE(o.name, '')
+		FROM agents a LEFT JOIN organizations o ON o.id = a.org_id
+		WHERE ? OR a.org_id IN (SELECT org_id FROM memberships WHERE user = ? AND role = ?)
+		ORDER BY a.id`, isSystemAdmin(user), user, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []adminAgent{}
+	for rows.Next() {
+		var agent adminAgent
+		if err := rows.Scan(&agent.ID, &agent.Name, &agent.Status, &agent.LastPing, &agent.Capacity, &agent.Load, &agent.User,
+			&agent.OrgID, &agent.Org); err != nil {
+			return nil, err
+		}
+		list = append(list, agent)
+	}
+	return list, rows.Err()
+}
+
+// getAdminQueues возвращает незавершённые задачи по пулам, которые видит администратор user
+func getAdminQueues(user string) ([]poolQueue, error) {
+	rows, err := db.Query(`SELECT COALESCE(e.org_id, 0), COALESCE(o.name, ''), CASE WHEN e.org_id IS NULL THEN e.user ELSE '' END AS pool_user,
+			SUM(t.status = 'queued'), SUM(t.status = 'leased'), SUM(t.status = 'waiting')
+		FROM tasks t JOIN expressions e ON e.id = t.expression_id
+		LEFT JOIN organizations o ON o.id = e.org_id
+		WHERE t.status IN ('queued', 'leased', 'waiting')
+		AND (? OR e.org_id IN (SELECT org_id FROM memberships WHERE user = ? AND role = ?))
+		GROUP BY 1, 2, 3
+		ORDER BY 2, 3`, isSystemAdmin(user), user, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []poolQueue{}
+	for rows.Next() {
+		var q poolQueue
+		if err := rows.Scan(&q.OrgID, &q.Org, &q.User, &q.Queued, &q.Leased, &q.Waiting); err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+// apiAdministrator возвращает пользователя запроса, если он может открыть администрирование,
+// или отвечает 401 или 403
+func apiAdministrator(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return "", false
+	}
+	user, ok := apiUser(w, r)
+	if !ok {
+		return "", false
+	}
+	allowed, err := canAdminister(user)
+	if err != nil {
+		log.Printf("Error checking access: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return "", false
+	}
+	if !allowed {
+		writeError(w, http.StatusForbidden, errForbidden.Error())
+		return "", false
+	}
+	return user, true
+}
+
+// GET /api/v1/admin/agents
+func apiAdminAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiAdministrator(w, r)
+	if !ok {
+		return
+	}
+	list, err := getAdminAgents(user)
+	if err != nil {
+		log.Printf("Error getting agents: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET /api/v1/admin/queues
+func apiAdminQueuesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiAdministrator(w, r)
+	if !ok {
+		return
+	}
+	list, err := getAdminQueues(user)
+	if err != nil {
+		log.Printf("Error getting queues: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// Страница администрирования: агенты и очереди
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := pageUser(w, r)
+	if !ok {
+		return
+	}
+	allowed, err := canAdminister(user)
+	if err != nil {
+		log.Printf("Error checking access: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	agents, err := getAdminAgents(user)
+	if err != nil {
+		log.Printf("Error getting agents: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	queues, err := getAdminQueues(user)
+	if err != nil {
+		log.Printf("Error getting queues: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("frontend/agentsAndmain/admin.html"))
+	data := struct {
+		SystemAdmin bool
+		Agents      []adminAgent
+		Queues      []poolQueue
+	}{
+		SystemAdmin: isSystemAdmin(user),
+		Agents:      agents,
+		Queues:      queues,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template: %v", err)
+	}
+}
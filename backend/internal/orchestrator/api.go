@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	agents "calc/backend/internal/agent"
+	"calc/backend/internal/expr"
+)
+
+// JSON API для скриптов и CI. Все ответы, включая ошибки, — JSON объекты.
+// Токен передаётся в заголовке Authorization: Bearer <токен> или в куке token.
+
+// Время операции в миллисекундах, если клиент его не указал
+const defaultOperationTime = 200
+
+type apiError struct {
+	Error string `json:"error"`
+	// Для синтаксических ошибок — позиция в выражении и что там ожидалось
+	Column   int      `json:"column,omitempty"`
+	Expected []string `json:"expected,omitempty"`
+}
+
+type credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type expressionRequest struct {
+	Expression string `json:"expression"`
+	// Профиль времени операций, если не указан — профиль пользователя по умолчанию
+	Profile string `json:"profile"`
+	// Организация, пул агентов которой вычисляет выражение, 0 — личные агенты
+	Org int `json:"org"`
+	// Время операций в миллисекундах поверх профиля, пропущенные берутся из профиля
+	Timings timingsRequest `json:"timings"`
+	// Срок вычисления в секундах, 0 — без срока, если не указан — срок по умолчанию
+	Timeout *int `json:"timeout"`
+	// Режим вычислений: float64 (по умолчанию), int, rat или float с точностью Precision бит
+	Mode      string `json:"mode"`
+	Precision int    `json:"precision"`
+}
+
+// timingsRequest — время операций в запросе. Указатели отличают явно заданный 0 от пропущенного поля.
+type timingsRequest struct {
+	Addition       *int           `json:"addition"`
+	Subtraction    *int           `json:"subtraction"`
+	Multiplication *int           `json:"multiplication"`
+	Division       *int           `json:"division"`
+	Exponent       *int           `json:"exponent"`
+	Functions      map[string]int `json:"functions"`
+	Operators      map[string]int `json:"operators"`
+}
+
+type apiAgent struct {
+	ID       int       `json:"id"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	LastPing time.Time `json:"last_ping"`
+	Capacity int       `json:"capacity"`
+	Load     int       `json:"load"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
+
+// writeSyntaxError отвечает 400 с ошибкой в выражении и, если она синтаксическая, её позицией
+func writeSyntaxError(w http.ResponseWriter, err error) {
+	resp := apiError{Error: err.Error()}
+	var syntaxErr *expr.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		resp.Column = syntaxErr.Pos.Column
+		resp.Expected = syntaxErr.Expected
+	}
+	writeJSON(w, http.StatusBadRequest, resp)
+}
+
+// isSyntaxError сообщает, что err — ошибка в выражении пользователя, а не сбой сервера
+func isSyntaxError(err error) bool {
+	var syntaxErr *expr.SyntaxError
+	return errors.As(err, &syntaxErr)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "метод не поддерживается")
+}
+
+// decodeJSON читает тело запроса в v и отвечает 400, если оно не разбирается
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("невалидный JSON: %v", err))
+		return false
+	}
+	return true
+}
+
+// decimalsParam читает из запроса число знаков после точки для поля formatted,
+// по умолчанию используется RESULT_DECIMALS
+func decimalsParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("decimals")
+	if value == "" {
+		return resultDecimals, true
+	}
+	decimals, err := strconv.Atoi(value)
+	if err != nil || decimals < -1 {
+		writeError(w, http.StatusBadRequest, "decimals должно быть числом от -1")
+		return 0, false
+	}
+	return decimals, true
+}
+
+// apiUser возвращает пользователя запроса или отвечает 401
+func apiUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := requestUser(r)
+	if err != nil || user == "" {
+		writeError(w, http.StatusUnauthorized, "требуется авторизация")
+		return "", false
+	}
+	return user, true
+}
+
+// POST /api/v1/auth/register
+func apiRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req credentials
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Login == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "требуются логин и пароль")
+		return
+	}
+
+	err := createUser(req.Login, req.Password)
+	if err == errUserExists {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	var weak weakPasswordError
+	if errors.As(err, &weak) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating user: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+
+	resp, err := issueSession(w, req.Login)
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// POST /api/v1/auth/login
+func apiLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req credentials
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	err := authenticate(req.Login, req.Password)
+	if err == errWrongLogin || err == errWrongPassword {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	var locked *lockoutError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter().Seconds())))
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking password: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+
+	resp, err := issueSession(w, req.Login)
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET и POST /api/v1/expressions. GET ?org=<ID> возвращает выражения организации.
+func apiExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		user, ok := apiUser(w, r)
+		if !ok {
+			return
+		}
+		decimals, ok := decimalsParam(w, r)
+		if !ok {
+			return
+		}
+		orgID, err := formOrganization(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var expressions []Expression
+		if orgID != 0 {
+			if !apiAuthorize(w, user, orgID, RoleViewer) {
+				return
+			}
+			expressions, err = getOrganizationExpressions(orgID)
+		} else {
+			expressions, err = getExpressions(user)
+		}
+		if err != nil {
+			log.Printf("Error getting expressions: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+		if expressions == nil {
+			expressions = []Expression{}
+		}
+		for i := range expressions {
+			expressions[i].Formatted = formatResult(expressions[i].Result, decimals)
+		}
+		writeJSON(w, http.StatusOK, expressions)
+	case http.MethodPost:
+		createExpression(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// createExpression ставит выражение из JSON тела в очередь и отвечает 202 с его ID
+func createExpression(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req expressionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Expression == "" {
+		writeError(w, http.StatusBadRequest, "требуется выражение")
+		return
+	}
+	if req.Org < 0 {
+		writeError(w, http.StatusBadRequest, "невалидный ID организации")
+		return
+	}
+	if req.Org != 0 && !apiAuthorize(w, user, req.Org, RoleOperator) {
+		return
+	}
+	// Определение функции f(x) = ... сохраняется, а не вычисляется
+	if isDefinition(req.Expression) {
+		createFunction(w, user, req.Expression)
+		return
+	}
+	numeric, err := newNumeric(req.Mode, req.Precision)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prepared, err := prepareExpression(req.Expression, user, numeric)
+	if isSyntaxError(err) {
+		writeSyntaxError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error preparing expression: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+
+	profile, err := loadProfile(user, req.Profile)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("профиль %q не найден", req.Profile))
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting profile: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	// Время из запроса заменяет время профиля и записывается вместе с выражением
+	overrides := make(map[string]int)
+	timings := []struct {
+		op      string
+		value   *int
+		profile *int
+	}{
+		{"+", req.Timings.Addition, &profile.Timings.Addition},
+		{"-", req.Timings.Subtraction, &profile.Timings.Subtraction},
+		{"*", req.Timings.Multiplication, &profile.Timings.Multiplication},
+		{"/", req.Timings.Division, &profile.Timings.Division},
+		{"^", req.Timings.Exponent, &profile.Timings.Exponent},
+	}
+	for _, t := range timings {
+		if t.value == nil {
+			continue
+		}
+		if *t.value < 0 {
+			writeError(w, http.StatusBadRequest, "время операций не может быть отрицательным")
+			return
+		}
+		*t.profile = *t.value
+		overrides[t.op] = *t.value
+	}
+	// Функции и операторы без времени агент считает со своим временем по умолчанию
+	costs := agents.Timings{Functions: req.Timings.Functions, Operators: req.Timings.Operators}
+	if err := costs.CheckCosts(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	profile.Timings.SetFunctions(costs.Functions)
+	profile.Timings.SetOperators(costs.Operators)
+	for name, ms := range costs.Functions {
+		overrides[name] = ms
+	}
+	for op, ms := range costs.Operators {
+		overrides[op] = ms
+	}
+
+	timeout := expressionTimeout
+	if req.Timeout != nil {
+		if *req.Timeout < 0 {
+			writeError(w, http.StatusBadRequest, "срок вычисления не может быть отрицательным")
+			return
+		}
+		timeout = time.Duration(*req.Timeout) * time.Second
+	}
+
+	id, err := HandleCalculateRequest(req.Expression, user, req.Org, timeout, numeric, profile, overrides, prepared)
+	if err != nil {
+		log.Printf("Error creating expression: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+
+	// Такое же выражение могло быть уже вычислено, поэтому отдаём его настоящий статус
+	exp, err := getExpression(id)
+	if err != nil {
+		log.Printf("Error getting expression: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/expressions/%d", id))
+	writeJSON(w, http.StatusAccepted, Accepted{ID: id, Status: exp.Status})
+}
+
+// GET и DELETE /api/v1/expressions/{id}
+func apiExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v1/expressions/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "невалидный ID выражения")
+		return
+	}
+
+	// Смотреть выражение организации может любой её участник, отменять — оператор
+	need := RoleViewer
+	if r.Method == http.MethodDelete {
+		need = RoleOperator
+	}
+	err = authorizeExpression(user, id, need)
+	if err == errForbidden {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	if err == nil && r.Method == http.MethodDelete {
+		err = cancelExpression(id)
+		if err == errExpressionFinished {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error cancelling expression: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+	}
+
+	if err == nil {
+		decimals, ok := decimalsParam(w, r)
+		if !ok {
+			return
+		}
+		var exp Expression
+		exp, err = getExpression(id)
+		if err == nil {
+			exp.Formatted = formatResult(exp.Result, decimals)
+			writeJSON(w, http.StatusOK, exp)
+			return
+		}
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "выражение не найдено")
+		return
+	}
+	log.Printf("Error getting expression: %v", err)
+	writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+}
+
+// GET /api/v1/agents
+func apiAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := getUserAgents(user)
+	if err != nil {
+		log.Printf("Error getting agents: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// apiNotFoundHandler отвечает JSON ошибкой на неизвестные пути /api/v1
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, "метод API не найден")
+}
+
+// getUserAgents возвращает агентов, зарегистрированных пользователем
+func getUserAgents(user string) ([]apiAgent, error) {
+	return queryAgents("user = ?", user)
+}
+
+// getOrganizationAgents возвращает пул агентов организации
+func getOrganizationAgents(orgID int) ([]apiAgent, error) {
+	return queryAgents("org_id = ?", orgID)
+}
+
+// queryAgents возвращает агентов, подходящих под условие where с одним параметром
+func queryAgents(where string, arg interface{}) ([]apiAgent, error) {
+	rows, err := db.Query("SELECT id, COALESCE(name, ''), status, last_ping, capacity, load FROM agents WHERE "+where+" ORDER BY id", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []apiAgent{}
+	for rows.Next() {
+		var agent apiAgent
+		if err := rows.Scan(&agent.ID, &agent.Name, &agent.Status, &agent.LastPing, &agent.Capacity, &agent.Load); err != nil {
+			return nil, err
+		}
+		list = append(list, agent)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Сколько действует выданный пользователю токен
+const tokenLifetime = 5 * time.Minute
+
+// Правила паролей и блокировки входа после неудачных попыток
+const (
+	minPasswordLength = 8
+	// bcrypt учитывает только первые 72 байта пароля
+	maxPasswordLength = 72
+	// После стольких неудачных попыток подряд вход блокируется
+	maxFailedLogins = 5
+	// Первая блокировка, каждая следующая неудачная попытка удваивает её, но не дольше lockoutMax
+	lockoutBase = 30 * time.Second
+	lockoutMax  = time.Hour
+)
+
+var (
+	errUserExists    = errors.New("пользователь уже существует")
+	errWrongLogin    = errors.New("Неправильный логин! Может, попробуйте зарегистрироваться?")
+	errWrongPassword = errors.New("Неправильный пароль!")
+)
+
+// weakPasswordError — пароль не подходит под правила, текст объясняет, чем именно
+type weakPasswordError string
+
+func (e weakPasswordError) Error() string { return string(e) }
+
+// lockoutError — вход заблокирован после слишком многих неудачных попыток
+type lockoutError struct {
+	Until time.Time
+}
+
+func (e *lockoutError) Error() string {
+	return fmt.Sprintf("слишком много неудачных попыток входа, попробуйте через %d с", int(e.RetryAfter().Seconds()))
+}
+
+// RetryAfter возвращает, через сколько вход снова станет доступен
+func (e *lockoutError) RetryAfter() time.Duration {
+	wait := time.Until(e.Until).Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// createUsersTable создаёт таблицу пользователей. Имя пользователя уникально на уровне схемы,
+// а в старых базах к таблице добавляются счётчик неудачных входов и время блокировки.
+func createUsersTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Name TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL,
+		failed_logins INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP
+	);`)
+	if err != nil {
+		return err
+	}
+	if err := addColumn("Users", "failed_logins", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("Users", "locked_until", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	// В старых базах Name не был уникальным
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_name ON Users (Name)")
+	if err != nil {
+		return fmt.Errorf("в таблице Users есть пользователи с одинаковыми именами: %v", err)
+	}
+	return nil
+}
+
+// checkPassword проверяет пароль на соответствие правилам
+func checkPassword(login, password string) error {
+	hasLetter, hasDigit := false, false
+	for _, r := range password {
+		hasLetter = hasLetter || unicode.IsLetter(r)
+		hasDigit = hasDigit || unicode.IsDigit(r)
+	}
+	switch {
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		return weakPasswordError(fmt.Sprintf("пароль должен быть не короче %d символов", minPasswordLength))
+	case len(password) > maxPasswordLength:
+		return weakPasswordError(fmt.Sprintf("пароль должен быть не длиннее %d байт", maxPasswordLength))
+	case !hasLetter || !hasDigit:
+		return weakPasswordError("пароль должен содержать буквы и цифры")
+	case strings.EqualFold(password, login):
+		return weakPasswordError("пароль не должен совпадать с логином")
+	}
+	return nil
+}
+
+// createUser регистрирует нового пользователя. Пароль хранится только в виде bcrypt хеша.
+func createUser(login, password string) error {
+	if err := checkPassword(login, password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	// Вставляем нового пользователя в базу данных. Занятое имя отклоняет уникальный индекс.
+	_, err = tx.Exec("INSERT INTO Users (Name, password) VALUES (?, ?)", login, string(hash))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// isPasswordHash сообщает, что пароль хранится bcrypt хешем, а не открытым текстом,
+// как у пользователей, зарегистрированных до хеширования
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// authenticate проверяет логин и пароль пользователя.
+// Пароль, сохранённый открытым текстом, при успешном входе заменяется хешем.
+// После maxFailedLogins неудачных попыток подряд вход блокируется, и каждая следующая
+// неудача удваивает блокировку; успешный вход сбрасывает счётчик.
+func authenticate(login, password string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var id, failed int
+	var stored string
+	var lockedUntil sql.NullTime
+	err = tx.QueryRow("SELECT id, password, failed_logins, locked_until FROM Users WHERE Name = ?", login).
+		Scan(&id, &stored, &failed, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return errWrongLogin
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if lockedUntil.Valid && now.Before(lockedUntil.Time) {
+		return &lockoutError{Until: lockedUntil.Time}
+	}
+
+	// Проверяем совпадение паролей
+	var ok bool
+	if isPasswordHash(stored) {
+		ok = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	} else {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+
+	if !ok {
+		failed++
+		var until sql.NullTime
+		if failed >= maxFailedLogins {
+			until = sql.NullTime{Time: now.Add(lockoutDuration(failed)), Valid: true}
+		}
+		_, err = tx.Exec("UPDATE Users SET failed_logins = ?, locked_until = ? WHERE id = ?", failed, until, id)
+		if err != nil {
+			return err
+		}
+		// Заканчиваем транзакцию, фиксируя изменения
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing transaction: %v", err)
+			return err
+		}
+		return errWrongPassword
+	}
+
+	if !isPasswordHash(stored) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		stored = string(hash)
+	}
+	_, err = tx.Exec("UPDATE Users SET password = ?, failed_logins = 0, locked_until = NULL WHERE id = ?", stored, id)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// lockoutDuration возвращает блокировку после failed неудачных попыток подряд
+func lockoutDuration(failed int) time.Duration {
+	d := lockoutBase
+	for i := maxFailedLogins; i < failed && d < lockoutMax; i++ {
+		d *= 2
+	}
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+	return d
+}
+
+// issueToken выдаёт пользователю JWT токен, подписанный текущим ключом сервера
+func issueToken(login string) (string, error) {
+	signingKeys.RLock()
+	kid, secret := signingKeys.current, signingKeys.keys[signingKeys.current]
+	signingKeys.RUnlock()
+	if secret == nil {
+		return "", errors.New("ключ подписи токенов не загружен")
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"name": login,
+		"nbf":  now.Unix(),
+		"exp":  now.Add(tokenLifetime).Unix(),
+		"iat":  now.Unix(),
+	})
+	token.Header["kid"] = kid
+	return token.SignedString(secret)
+}
+
+// setTokenCookie кладёт токен в куку, с которой работают HTML страницы
+func setTokenCookie(w http.ResponseWriter, tokenString string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    tokenString,
+		Path:     "/",
+		MaxAge:   int(tokenLifetime.Seconds()),
+		HttpOnly: true, // Чтобы кука была доступна только для HTTP запросов, а не JavaScript
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// parseToken проверяет JWT токен и возвращает имя пользователя из него
+func parseToken(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, signingKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		// Если произошла ошибка при декодировании токена или токен невалиден
+		return "", errors.New("невалидный токен")
+	}
+
+	user, ok := token.Claims.(jwt.MapClaims)["name"].(string)
+	if !ok || user == "" {
+		return "", errors.New("неверный формат поля 'name' в токене")
+	}
+	return user, nil
+}
+
+// requestUser возвращает пользователя запроса: скрипты передают токен
+// в заголовке Authorization: Bearer, браузер — в куке
+func requestUser(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		tokenString := strings.TrimPrefix(header, "Bearer ")
+		if tokenString == header {
+			return "", errors.New("ожидается заголовок Authorization: Bearer <токен>")
+		}
+		return parseToken(tokenString)
+	}
+	return getCookieToken(r)
+}
+
+// cookieUser возвращает пользователя из куки token. Если access токен истёк, он прозрачно
+// обновляется по куке refresh_token, а новые токены кладутся в куки ответа.
+func cookieUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if user, err := getCookieToken(r); err == nil && user != "" {
+		return user, true
+	}
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	user, err := useRefreshToken(cookie.Value)
+	if err != nil {
+		if err != errInvalidRefreshToken {
+			log.Printf("Error using refresh token: %v", err)
+		}
+		return "", false
+	}
+	if _, err := issueSession(w, user); err != nil {
+		log.Printf("Error issuing tokens: %v", err)
+		return "", false
+	}
+	return user, true
+}
+
+// pageUser возвращает пользователя страницы или отправляет его на страницу входа
+func pageUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := cookieUser(w, r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return "", false
+	}
+	return user, true
+}
+
+// formUser возвращает пользователя запроса со страницы или отвечает 401 с JSON ошибкой
+func formUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := cookieUser(w, r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "требуется авторизация")
+		return "", false
+	}
+	return user, true
+}
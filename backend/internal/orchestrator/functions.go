@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"calc/backend/internal/expr"
+)
+
+// UserFunction — функция пользователя, определённая выражением вида f(x, y) = x^2 + 2*x*y
+type UserFunction struct {
+	Name       string   `json:"name"`
+	Params     []string `json:"params"`
+	Definition string   `json:"definition"`
+}
+
+var errFunctionInUse = errors.New("функцию вызывают другие функции")
+
+// createFunctionsTable создаёт таблицу функций пользователей
+func createFunctionsTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS user_functions (
+		user TEXT NOT NULL,
+		name TEXT NOT NULL,
+		definition TEXT NOT NULL,
+		PRIMARY KEY (user, name)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Определения функций, с которыми вычисляется выражение, в виде JSON объекта {"f": "f(x) = 2x"}
+	return addColumn("expressions", "definitions", "TEXT")
+}
+
+// isDefinition сообщает, что expression — определение функции, а не выражение
+func isDefinition(expression string) bool {
+	tree, err := expr.Parse(expression)
+	if err != nil {
+		return false
+	}
+	_, ok := tree.(*expr.Definition)
+	return ok
+}
+
+// loadFunctions возвращает функции пользователя и тексты их определений по именам
+func loadFunctions(user string) (map[string]*expr.Definition, map[string]string, error) {
+	rows, err := db.Query("SELECT name, definition FROM user_functions WHERE user = ?", user)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	texts := make(map[string]string)
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, nil, err
+		}
+		texts[name] = definition
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	funcs, err := expr.ParseDefinitions(texts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return funcs, texts, nil
+}
+
+// usedDefinitions возвращает тексты функций пользователя, которые вызывает выражение
+func usedDefinitions(tree expr.Node, funcs map[string]*expr.Definition, texts map[string]string) map[string]string {
+	definitions := make(map[string]string)
+	for name := range expr.UsedFunctions(tree, funcs) {
+		definitions[name] = texts[name]
+	}
+	return definitions
+}
+
+// defineFunction сохраняет функцию пользователя или заменяет прежнюю с тем же именем.
+// Весь набор функций пользователя проверяется заново: новое определение не должно создавать циклов
+// и ломать вызовы из других функций. Выражения, которые вызывают функцию, вычисляются заново.
+func defineFunction(user, definition string) (UserFunction, error) {
+	tree, err := expr.Parse(definition)
+	if err != nil {
+		return UserFunction{}, err
+	}
+	def, ok := tree.(*expr.Definition)
+	if !ok {
+		return UserFunction{}, &expr.SyntaxError{Pos: tree.Position(), Message: "ожидалось определение функции вида f(x, y) = x^2 + 2*x*y"}
+	}
+
+	funcs, _, err := loadFunctions(user)
+	if err != nil {
+		return UserFunction{}, err
+	}
+	funcs[def.Name] = def
+	if err := expr.CheckDefinitions(funcs); err != nil {
+		return UserFunction{}, err
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return UserFunction{}, err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var previous string
+	err = tx.QueryRow("SELECT definition FROM user_functions WHERE user = ? AND name = ?", user, def.Name).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return UserFunction{}, err
+	}
+	_, err = tx.Exec(`INSERT INTO user_functions (user, name, definition) VALUES (?, ?, ?)
+		ON CONFLICT (user, name) DO UPDATE SET definition = excluded.definition`, user, def.Name, definition)
+	if err != nil {
+		return UserFunction{}, err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return UserFunction{}, err
+	}
+
+	if previous != "" && previous != definition {
+		go reevaluateDependents(user, "definitions", def.Name)
+	}
+	return UserFunction{Name: def.Name, Params: def.Params, Definition: definition}, nil
+}
+
+func getFunctions(user string) ([]UserFunction, error) {
+	funcs, texts, err := loadFunctions(user)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(texts))
+	for name := range texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := []UserFunction{}
+	for _, name := range names {
+		list = append(list, UserFunction{Name: name, Params: funcs[name].Params, Definition: texts[name]})
+	}
+	return list, nil
+}
+
+// deleteFunction удаляет функцию, если её не вызывают другие функции пользователя
+func deleteFunction(user, name string) error {
+	funcs, _, err := loadFunctions(user)
+	if err != nil {
+		return err
+	}
+	if _, ok := funcs[name]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(funcs, name)
+	for _, def := range funcs {
+		called := false
+		expr.Inspect(def.Body, func(n expr.Node) bool {
+			if call, ok := n.(*expr.Call); ok && call.Name == name {
+				called = true
+			}
+			return !called
+		})
+		if called {
+			return errFunctionInUse
+		}
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	_, err = tx.Exec("DELETE FROM user_functions WHERE user = ? AND name = ?", user, name)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GET и POST /api/v1/functions. Тело POST — {"definition": "f(x, y) = x^2 + 2*x*y"}.
+func apiFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Definition string `json:"definition"`
+		}
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		createFunction(w, user, req.Definition)
+		return
+	}
+
+	list, err := getFunctions(user)
+	if err != nil {
+		log.Printf("Error getting functions: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createFunction определяет функцию и отвечает 201 с её описанием
+func createFunction(w http.ResponseWriter, user, definition string) {
+	fn, err := defineFunction(user, definition)
+	if isSyntaxError(err) {
+		writeSyntaxError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("Error defining function: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/functions/"+fn.Name)
+	writeJSON(w, http.StatusCreated, fn)
+}
+
+// GET и DELETE /api/v1/functions/{name}
+func apiFunctionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/functions/")
+	if r.Method == http.MethodDelete {
+		err := deleteFunction(user, name)
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "функция не найдена")
+		case err == errFunctionInUse:
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			log.Printf("Error deleting function: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	list, err := getFunctions(user)
+	if err != nil {
+		log.Printf("Error getting functions: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	for _, fn := range list {
+		if fn.Name == name {
+			writeJSON(w, http.StatusOK, fn)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "функция не найдена")
+}
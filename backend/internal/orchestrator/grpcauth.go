@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Агент подтверждает себя в метаданных каждого вызова gRPC: agent-id и authorization: Bearer <токен агента>.
+// Register вместо этого принимает access токен пользователя, которому будет принадлежать агент.
+const (
+	agentIDMetadata       = "agent-id"
+	authorizationMetadata = "authorization"
+)
+
+// Метод, для которого у агента ещё нет своего токена
+const registerMethod = "/orchest.Orchestrator/Register"
+
+type agentContextKey struct{}
+
+type userContextKey struct{}
+
+// agentUnaryInterceptor пропускает к обычным методам только подтверждённых агентов
+func agentUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticateCall(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authenticatedStream — поток, в контексте которого лежит подтверждённый агент
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context { return s.ctx }
+
+// agentStreamInterceptor пропускает к Connect только подтверждённых агентов
+func agentStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticateCall(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticateCall проверяет токен из метаданных вызова и кладёт в контекст пользователя (для Register)
+// или агента (для остальных методов)
+func authenticateCall(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	token, err := bearerToken(md)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == registerMethod {
+		user, err := parseToken(token)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "неверный токен пользователя: %v", err)
+		}
+		return context.WithValue(ctx, userContextKey{}, user), nil
+	}
+
+	ids := md.Get(agentIDMetadata)
+	if len(ids) != 1 || ids[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "не указан ID агента")
+	}
+	agent, err := getAgent(ids[0])
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting agent: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// Неизвестный агент и неверный токен неразличимы для вызывающего
+	if err == sql.ErrNoRows || !agent.validToken(token) {
+		return nil, status.Errorf(codes.Unauthenticated, "неизвестный агент %s или неверный токен", ids[0])
+	}
+	return context.WithValue(ctx, agentContextKey{}, agent), nil
+}
+
+// bearerToken достаёт токен из метаданных authorization: Bearer <токен>
+func bearerToken(md metadata.MD) (string, error) {
+	values := md.Get(authorizationMetadata)
+	if len(values) != 1 {
+		return "", status.Error(codes.Unauthenticated, "не передан токен")
+	}
+	token := strings.TrimPrefix(values[0], "Bearer ")
+	if token == values[0] || token == "" {
+		return "", status.Error(codes.Unauthenticated, "ожидаются метаданные authorization: Bearer <токен>")
+	}
+	return token, nil
+}
+
+// contextAgent возвращает агента, подтверждённого перехватчиком
+func contextAgent(ctx context.Context) Agent {
+	agent, _ := ctx.Value(agentContextKey{}).(Agent)
+	return agent
+}
+
+// contextUser возвращает пользователя, чей токен передан в Register
+func contextUser(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey{}).(string)
+	return user
+}
+
+// checkAgentID проверяет, что ID агента в сообщении, если он указан, — ID подтверждённого агента
+func checkAgentID(agent Agent, id string) error {
+	if id != "" && id != strconv.Itoa(agent.ID) {
+		return status.Errorf(codes.PermissionDenied, "агент %d не может действовать от имени агента %s", agent.ID, id)
+	}
+	return nil
+}
+
+// grpcServerOptions возвращает перехватчики, проверяющие агентов, и, если заданы GRPC_TLS_CERT
+// и GRPC_TLS_KEY, сертификат, с которым весь gRPC идёт по TLS
+func grpcServerOptions() ([]grpc.ServerOption, error) {
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(agentUnaryInterceptor),
+		grpc.StreamInterceptor(agentStreamInterceptor),
+	}
+
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return options, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("для TLS нужны и GRPC_TLS_CERT, и GRPC_TLS_KEY")
+	}
+	creds, err := grpccreds.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки сертификата gRPC: %v", err)
+	}
+	log.Printf("gRPC сервер работает по TLS")
+	return append(options, grpc.Creds(creds)), nil
+}
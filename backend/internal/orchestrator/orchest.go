@@ -2,28 +2,35 @@ package main
 
 import (
 	agents "calc/backend/internal/agent"
-	agentrpc "calc/backend/internal/proto/calc_agent"
+	"calc/backend/internal/expr"
 	orchest "calc/backend/internal/proto/orchest"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
-	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/sessions"
 
 	_ "github.com/mattn/go-sqlite3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 type orchestratorServer struct {
@@ -34,28 +41,38 @@ var db *sql.DB
 
 var store = sessions.NewCookieStore([]byte("aB7sZ2YpF8jHrK5dMlNwQxUcJvTgX3eEiVfRtGyBhN7uK4jT6fAzSxC1DvFbGh9"))
 
-var op1Int int
-var op2Int int
-var op3Int int
-var op4Int int
-var op5Int int
-
-type Result struct {
-	Result string `json:"result"`
+type Accepted struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
 }
 
 type Agent struct {
-	ID     int
-	Port   int
-	Status string
-	User   string
+	ID        int
+	Status    string
+	User      string
+	TokenHash string
+	// Организация, в пул которой входит агент, 0 — личный агент пользователя
+	OrgID int
 }
 
 type Expression struct {
-	ID         int
-	Expression string
-	Result     int
-	Status     string
+	ID         int    `json:"id"`
+	Expression string `json:"expression"`
+	// Result — точный результат в виде десятичной строки, Formatted — он же для показа
+	Result    string `json:"result,omitempty"`
+	Formatted string `json:"formatted,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	// Режим вычислений и точность big.Float
+	Mode      string `json:"mode"`
+	Precision int    `json:"precision,omitempty"`
+	// Профиль времени операций, с которым вычислялось выражение,
+	// и время операций в миллисекундах, заданное в запросе поверх профиля
+	Profile         string         `json:"profile,omitempty"`
+	TimingOverrides map[string]int `json:"timing_overrides,omitempty"`
+	// Автор выражения и организация, пул которой его вычисляет, 0 — личные агенты автора
+	User  string `json:"user"`
+	OrgID int    `json:"org_id,omitempty"`
 }
 
 type User struct {
@@ -86,15 +103,6 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func loginCheckHandler(w http.ResponseWriter, r *http.Request) {
-	// Начинаем транзакцию
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error beginning transaction: %v", err)
-		return
-	}
-	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
-
 	// Получаем данные из формы
 	login := r.FormValue("login")
 	password := r.FormValue("password")
@@ -116,64 +124,39 @@ func loginCheckHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Получаем хеш пароля из базы данных
-	var passwordHash string
-	err = tx.QueryRow("SELECT password FROM Users WHERE Name = ?", login).Scan(&passwordHash)
-	if err != nil {
-		errorMessage := map[string]string{"error": "Неправильный логин! Может, попробуйте зарегистрироваться?"}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(errorMessage)
-		return
-	}
-
-	// Проверяем совпадение паролей
-	if password != passwordHash {
-		errorMessage := map[string]string{"error": "Неправильный пароль!"}
+	// Проверяем логин и пароль
+	if err := authenticate(login, password); err != nil {
+		status := http.StatusUnauthorized
+		var locked *lockoutError
+		if errors.As(err, &locked) {
+			// Вход временно заблокирован после неудачных попыток
+			status = http.StatusTooManyRequests
+			w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter().Seconds())))
+		} else if err != errWrongLogin && err != errWrongPassword {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			log.Printf("Error checking password: %v", err)
+			return
+		}
+		errorMessage := map[string]string{"error": err.Error()}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(errorMessage)
 		return
 	}
 
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error committing transaction: %v", err)
-		return
-	}
-
 	session, err := store.Get(r, login)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	session.Save(r, w)
 
-	// Генерируем JWT токен
-	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"name": login,
-		"nbf":  now.Unix(),
-		"exp":  now.Add(5 * time.Minute).Unix(),
-		"iat":  now.Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(login))
+	// Генерируем JWT токен и refresh токен и устанавливаем их в куки
+	response, err := issueSession(w, login)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Формируем ответ с токеном в формате JSON
-	response := map[string]string{"token": tokenString}
-
-	// Устанавливаем токен в куки
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		HttpOnly: true, // Чтобы кука была доступна только для HTTP запросов, а не JavaScript
-	})
-
 	// Устанавливаем заголовок Content-Type и отправляем ответ
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -198,76 +181,43 @@ func registerCheckHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Начинаем транзакцию
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error beginning transaction: %v", err)
-		return
-	}
-	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 	// Получаем данные из формы
 	login := r.FormValue("login")
 	password := r.FormValue("password")
 
-	count := 0
-	err = tx.QueryRow("SELECT COUNT(*) FROM Users WHERE Name = ?", login).Scan(&count)
-	if err != nil {
-		log.Print(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Вставляем нового пользователя в базу данных
+	err := createUser(login, password)
+	if err == errUserExists {
+		http.Error(w, "User already exists", http.StatusBadRequest)
 		return
 	}
-	if count > 0 {
-		http.Error(w, "User already exists", http.StatusBadRequest)
+	var weak weakPasswordError
+	if errors.As(err, &weak) {
+		errorMessage := map[string]string{"error": err.Error()}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorMessage)
 		return
 	}
-
-	// Вставляем нового пользователя в базу данных
-	_, err = tx.Exec("INSERT INTO Users (Name, password) VALUES (?, ?)", login, password)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Error committing transaction: %v", err)
-		return
-	}
-
-	// Генерируем JWT токен
-	now := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"name": login,
-		"nbf":  now.Unix(),
-		"exp":  now.Add(5 * time.Minute).Unix(),
-		"iat":  now.Unix(),
-	})
-
 	session, err := store.Get(r, login)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	session.Save(r, w)
 
-	tokenString, err := token.SignedString([]byte(login))
+	// Генерируем JWT токен и refresh токен и устанавливаем их в куки
+	response, err := issueSession(w, login)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Формируем ответ с токеном в формате JSON
-	response := map[string]string{"token": tokenString}
-
-	// Устанавливаем токен в куки
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		HttpOnly: true, // Чтобы кука была доступна только для HTTP запросов, а не JavaScript
-	})
-
 	// Устанавливаем заголовок Content-Type и отправляем ответ
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -279,15 +229,12 @@ func orchestrateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем куку с именем "token" из запроса
-	user, err := getCookieToken(r)
-	if err != nil {
-		// Обработка ошибки, если кука не найдена или не может быть прочитана
-		log.Print(err.Error())
-	}
+	// Получаем пользователя из куки "token", обновляя истёкший токен по куке "refresh_token"
+	user, _ := cookieUser(w, r)
 
 	var isauth bool
 	var session *sessions.Session
+	var err error
 
 	// Проверяем, есть ли имя пользователя
 	if user != "" {
@@ -310,58 +257,65 @@ func orchestrateHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Получаем значения из сессии или используем дефолтные значения
 	expression := getOrDefault(session.Values["expression"], "")
-	addition := getOrDefault(session.Values["addition"], "200")
-	subtraction := getOrDefault(session.Values["subtraction"], "200")
-	multiplication := getOrDefault(session.Values["multiplication"], "200")
-	division := getOrDefault(session.Values["division"], "200")
-	exponent := getOrDefault(session.Values["exponent"], "200")
-
-	// Преобразование строковых значений в целые числа
-	op1Int, err = strconv.Atoi(addition)
-	if err != nil {
-		log.Printf("the session value(addition) is not int: %v\n", err)
-	}
-	op2Int, err = strconv.Atoi(subtraction)
-	if err != nil {
-		log.Printf("the session value(addition) is not int: %v\n", err)
-	}
-	op3Int, err = strconv.Atoi(multiplication)
-	if err != nil {
-		log.Printf("the session value(addition) is not int: %v\n", err)
-	}
-	op4Int, err = strconv.Atoi(division)
-	if err != nil {
-		log.Printf("the session value(addition) is not int: %v\n", err)
-	}
-	op5Int, err = strconv.Atoi(exponent)
-	if err != nil {
-		log.Printf("the session value(addition) is not int: %v\n", err)
-	}
+	mode := getOrDefault(session.Values["mode"], "float64")
+	precision := getOrDefault(session.Values["precision"], "")
+	profile := getOrDefault(session.Values["profile"], "")
 
-	expressions, err := getExpressions(user)
-	if err != nil {
-		log.Printf("вы не авторизованы")
+	// Данные пользователя показываем только ему самому
+	var expressions []Expression
+	var variables []Variable
+	var userFunctions []UserFunction
+	var profiles []Profile
+	var orgs []Organization
+	if isauth {
+		if expressions, err = getExpressions(user); err != nil {
+			log.Printf("Error getting expressions: %v", err)
+		}
+		if variables, err = getVariables(user); err != nil {
+			log.Printf("Error getting variables: %v", err)
+		}
+		if userFunctions, err = getFunctions(user); err != nil {
+			log.Printf("Error getting functions: %v", err)
+		}
+		if profiles, err = getProfiles(user); err != nil {
+			log.Printf("Error getting profiles: %v", err)
+		}
+		if orgs, err = operatorOrganizations(user); err != nil {
+			log.Printf("Error getting organizations: %v", err)
+		}
+	}
+	// Без выбранного в прошлый раз профиля выбран профиль по умолчанию
+	if profile == "" {
+		for _, p := range profiles {
+			if p.Default {
+				profile = p.Name
+			}
+		}
 	}
 
 	// Отображаем страницу агентов с информацией из базы данных
 	tmpl := template.Must(template.ParseFiles("frontend/agentsAndmain/index.html"))
 	data := struct {
 		Expression      string
-		Addition        string
-		Subtraction     string
-		Multiplication  string
-		Division        string
-		Exponent        string
+		Mode            string
+		Precision       string
+		Profile         string
+		Profiles        []Profile
+		Orgs            []Organization
 		Expressions     []Expression
+		Variables       []Variable
+		UserFunctions   []UserFunction
 		IsAuthenticated bool
 	}{
 		Expression:      expression,
-		Addition:        addition,
-		Subtraction:     subtraction,
-		Multiplication:  multiplication,
-		Division:        division,
-		Exponent:        exponent,
+		Mode:            mode,
+		Precision:       precision,
+		Profile:         profile,
+		Profiles:        profiles,
+		Orgs:            orgs,
 		Expressions:     expressions,
+		Variables:       variables,
+		UserFunctions:   userFunctions,
 		IsAuthenticated: isauth,
 	}
 
@@ -382,33 +336,8 @@ func getCookieToken(r *http.Request) (string, error) {
 		return "", errors.New("токен авторизации не найден, либо он повреждён")
 	}
 
-	// Извлекаем значение токена из куки
-	tokenString := cookie.Value
-
-	// Парсим и проверяем токен
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Проверяем, что токен имеет тип jwt.MapClaims
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			return nil, errors.New("неверный формат токена")
-		}
-
-		// Извлекаем имя пользователя из токена
-		user, ok := claims["name"].(string)
-		if !ok {
-			return nil, errors.New("неверный формат поля 'name' в токене")
-		}
-		// // Используем логин пользователя для создания ключа
-		return []byte(user), nil
-	})
-	if err != nil && !token.Valid {
-		// Если произошла ошибка при декодировании токена или токен невалиден
-		return "", errors.New("невалидный токен")
-	}
-
-	// Теперь вы можете использовать имя пользователя, например, для аутентификации или других действий
-	user := token.Claims.(jwt.MapClaims)["name"].(string)
-	return user, nil
+	// Парсим и проверяем токен из куки
+	return parseToken(cookie.Value)
 }
 
 // Обработчик для вычисления выражения
@@ -422,113 +351,151 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Требуется выражение", http.StatusBadRequest)
 		return
 	}
-	add, err := strconv.Atoi(r.FormValue("addition"))
-	if err != nil {
-		http.Error(w, "Невалидная скорость сложения", http.StatusBadRequest)
-		return
-	}
-	subt, err := strconv.Atoi(r.FormValue("subtraction"))
-	if err != nil {
-		http.Error(w, "Невалидная скорость вычитания", http.StatusBadRequest)
-		return
+	// Срок вычисления в секундах необязателен, 0 — без срока
+	timeout := expressionTimeout
+	if value := r.FormValue("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			http.Error(w, "Невалидный срок вычисления", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
 	}
-	multip, err := strconv.Atoi(r.FormValue("multiplication"))
-	if err != nil {
-		http.Error(w, "Невалидная скорость умножения", http.StatusBadRequest)
-		return
+	// Режим вычислений и точность необязательны, по умолчанию float64
+	precision := 0
+	if value := r.FormValue("precision"); value != "" {
+		var err error
+		precision, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Невалидная точность", http.StatusBadRequest)
+			return
+		}
 	}
-	div, err := strconv.Atoi(r.FormValue("division"))
+	numeric, err := newNumeric(r.FormValue("mode"), precision)
 	if err != nil {
-		http.Error(w, "Невалидная скорость деления", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	exp, err := strconv.Atoi(r.FormValue("exponent"))
-	if err != nil {
-		http.Error(w, "Невалидная скорость степени", http.StatusBadRequest)
+
+	// Получаем пользователя из токена в куке
+	user, ok := formUser(w, r)
+	if !ok {
 		return
 	}
-	var notval bool
 
-	// Получаем куку с именем "token" из запроса
-	cookie, err := r.Cookie("token")
+	// Выражение, отправленное в организацию, вычисляет её пул агентов
+	orgID, err := formOrganization(r)
 	if err != nil {
-		// Обработка ошибки, если кука не найдена или не может быть прочитана
-		http.Error(w, "Токен авторизации для вычислений не найден", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Извлекаем значение токена из куки
-	tokenString := cookie.Value
-
-	// Парсим и проверяем токен
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Извлекаем имя пользователя из токена
-		user := token.Claims.(jwt.MapClaims)["name"].(string)
-		// Используем логин пользователя для создания ключа
-		return []byte(user), nil
-	})
-	if err != nil || !token.Valid {
-		// Если произошла ошибка при декодировании токена или токен невалиден
-		http.Error(w, "Невалидный токен", http.StatusUnauthorized)
+	if err := authorizePool(user, orgID, RoleOperator); err != nil {
+		http.Error(w, err.Error(), policyStatus(err))
 		return
 	}
 
-	// Теперь вы можете использовать имя пользователя, например, для аутентификации или других действий
-	user := token.Claims.(jwt.MapClaims)["name"].(string)
-
 	session, _ := store.Get(r, user)
 
-	if user == "" {
-		// Формируем ответ с токеном в формате JSON
-		response := map[string]string{"error": "Токен должен быть обязательным!"}
-		// Устанавливаем заголовок Content-Type и отправляем ответ
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	// Время операций берётся из профиля пользователя, а не из формы
+	profile, err := loadProfile(user, r.FormValue("profile"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Профиль не найден", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Получаем значения из POST-запроса
 	session.Values["expression"] = expr
-	session.Values["addition"] = r.FormValue("addition")
-	session.Values["subtraction"] = r.FormValue("subtraction")
-	session.Values["multiplication"] = r.FormValue("multiplication")
-	session.Values["division"] = r.FormValue("division")
-	session.Values["exponent"] = r.FormValue("exponent")
+	session.Values["mode"] = string(numeric.Mode)
+	session.Values["precision"] = r.FormValue("precision")
+	session.Values["profile"] = profile.Name
 	session.Save(r, w)
 
 	// Проверяем выражение
-	if !isValidExpression(expr) {
-		http.Error(w, "Невалидное выражение", http.StatusBadRequest)
-		return
-	}
-
-	// Если валидно, вычисляем
-	if !notval {
-		// вычисляем
-		result, err := HandleCalculateRequest(expr, user, add, subt, multip, div, exp)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Определение функции f(x) = ... сохраняется, а не вычисляется
+	if isDefinition(expr) {
+		fn, err := defineFunction(user, expr)
+		if isSyntaxError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Обертываем результат в JSON и отправляем клиенту
-		response := Result{Result: strconv.Itoa(result)}
-		jsonResponse, err := json.Marshal(response)
 		if err != nil {
-			http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonResponse)
-	} else {
-		// Ну если нет...
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		errorMessage := map[string]string{"error": "Невалидное выражение"}
-		json.NewEncoder(w).Encode(errorMessage)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(fn)
+		return
+	}
+	prepared, err := prepareExpression(expr, user, numeric)
+	if isSyntaxError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Если валидно, ставим выражение в очередь, результат клиент запрашивает по ID
+	id, err := HandleCalculateRequest(expr, user, orgID, timeout, numeric, profile, nil, prepared)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Обертываем ID выражения в JSON и отправляем клиенту
+	response := Accepted{ID: id, Status: "pending"}
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonResponse)
+}
+
+// Обработчик для получения статуса и результата выражения по ID
+func expressionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := formUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Невалидный ID выражения", http.StatusBadRequest)
+		return
+	}
+
+	err = authorizeExpression(user, id, RoleViewer)
+	var exp Expression
+	if err == nil {
+		exp, err = getExpression(id)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Выражение не найдено", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting expression: %v", err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(exp)
 }
 
 func updateAgentStatus(agentID, status string) error {
@@ -555,71 +522,132 @@ func updateAgentStatus(agentID, status string) error {
 	return nil
 }
 
-// Реализация метода Ping
+// updateAgentLoad сохраняет время последнего пульса агента, число его вычислителей и текущую загрузку
+func updateAgentLoad(agentID, capacity, load int) error {
+	_, err := db.Exec("UPDATE agents SET last_ping = ?, capacity = ?, load = ? WHERE id = ?", time.Now(), capacity, load, agentID)
+	return err
+}
+
+// Реализация метода Register: агент получает пользователя из его access токена
+func (s orchestratorServer) Register(ctx context.Context, req *orchest.RegisterRequest) (*orchest.RegisterResponse, error) {
+	user := contextUser(ctx)
+	if req.GetUser() != "" && req.GetUser() != user {
+		return nil, status.Errorf(codes.PermissionDenied, "токен пользователя %s не позволяет зарегистрировать агента пользователя %s", user, req.GetUser())
+	}
+
+	// Агент организации входит в её общий пул, подключать агентов может оператор
+	orgID := 0
+	if req.GetOrg() != "" {
+		var err error
+		orgID, err = organizationID(req.GetOrg())
+		if err == nil {
+			err = authorize(user, orgID, RoleOperator)
+		}
+		switch {
+		case err == errNotMember:
+			return nil, status.Errorf(codes.NotFound, "организация %s не найдена", req.GetOrg())
+		case err == errForbidden:
+			return nil, status.Errorf(codes.PermissionDenied, "пользователь %s не может подключать агентов к организации %s", user, req.GetOrg())
+		case err != nil:
+			log.Printf("Error checking access: %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := checkAgentName(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	id, token, err := registerAgent(user, req.GetName(), orgID)
+	if err != nil {
+		log.Printf("Error registering agent: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	log.Printf("Зарегистрирован агент %d пользователя %s", id, user)
+	return &orchest.RegisterResponse{AgentId: strconv.Itoa(id), Token: token}, nil
+}
+
+// Реализация метода Ping. Агента и пользователя определяет токен, а не поля запроса.
 func (s orchestratorServer) Ping(ctx context.Context, req *orchest.PingRequest) (*orchest.PingResponse, error) {
-	// Получаем ID агента из запроса
-	agentID := req.GetAgentId()
-	user := req.GetUser()
+	agent := contextAgent(ctx)
+	if err := checkAgentID(agent, req.GetAgentId()); err != nil {
+		return nil, err
+	}
 
 	// Логируем информацию о пинге от агента
-	log.Printf("Получен пинг от агента %s пользователя %s", agentID, user)
+	log.Printf("Получен пинг от агента %d пользователя %s", agent.ID, agent.User)
 
 	// Обновляем статус агента в базе данных
-	if err := updateAgentStatus(agentID, "alive"); err != nil {
+	if err := updateAgentStatus(strconv.Itoa(agent.ID), "alive"); err != nil {
 		log.Printf("Error updating agent status: %v", err)
 		return nil, err
 	}
 
-	err := checkFreeExpressions(user)
-	if err != nil {
-		log.Fatal(err)
-	}
 	// Возвращаем успешный ответ
 	return &orchest.PingResponse{Message: "Пинг успешно принят"}, nil
 }
 
-func checkFreeExpressions(user string) error { // Начинаем транзакцию
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
-		return err
+// Реализация метода GetTask: агент забирает задачу из очереди в аренду
+func (s orchestratorServer) GetTask(ctx context.Context, req *orchest.AgentInfo) (*orchest.Task, error) {
+	agent := contextAgent(ctx)
+	if err := checkAgentID(agent, req.GetAgentId()); err != nil {
+		return nil, err
 	}
-	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 
-	rows, err := tx.Query("SELECT expression, status FROM expressions WHERE user = $1", user)
+	task, err := leaseTask(agent)
+	if err == errNotMember || err == errForbidden {
+		return nil, status.Errorf(codes.PermissionDenied, "пользователь %s больше не может подключать агентов к организации", agent.User)
+	}
 	if err != nil {
-		return err
+		log.Printf("Error leasing task: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-
-	var express, status string
-	for rows.Next() {
-
-		if err := rows.Scan(&express, &status); err != nil {
-			return err
-		}
-
-		if status == "pending" {
-			break
-		}
+	if task == nil {
+		return nil, status.Error(codes.NotFound, "нет свободных задач")
 	}
-	rows.Close()
 
-	// Заканчиваем транзакцию, фиксируя изменения
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		return err
+	return taskMessage(task), nil
+}
+
+// Реализация метода SubmitResult: агент возвращает результат арендованной задачи
+func (s orchestratorServer) SubmitResult(ctx context.Context, req *orchest.TaskResult) (*orchest.Ack, error) {
+	agent := contextAgent(ctx)
+	if err := checkAgentID(agent, req.GetAgentId()); err != nil {
+		return nil, err
 	}
 
-	_, err = HandleCalculateRequest(express, user, op1Int, op2Int, op3Int, op4Int, op5Int)
-	if err != nil {
-		log.Printf("Error while evaluate: %v", err)
+	if err := handleTaskResult(agent.ID, req); err != nil {
+		if err == errLeaseLost {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		log.Printf("Error handling result of task %d: %v", req.GetTaskId(), err)
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return nil
+	return &orchest.Ack{Message: "Результат принят"}, nil
 }
 
 // Обработчик для отображения информации об агентах
 func agentsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := pageUser(w, r)
+	if !ok {
+		return
+	}
+	// Организации, к пулам которых пользователь может подключить агента
+	orgs, err := operatorOrganizations(user)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error getting organizations: %v", err)
+		return
+	}
+	canAdmin, err := canAdminister(user)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error checking access: %v", err)
+		return
+	}
+
 	// Начинаем транзакцию
 	tx, err := db.Begin()
 	if err != nil {
@@ -633,34 +661,19 @@ func agentsHandler(w http.ResponseWriter, r *http.Request) {
 		ID         string
 		Status     string
 		LastActive time.Time
+		Capacity   int
+		Load       int
 	}
 
-	user, err := getCookieToken(r)
+	// Получаем сессию по имени пользователя
+	session, err := store.Get(r, user)
 	if err != nil {
-		log.Printf("Internal Server Error: %v", err)
-	}
-
-	var session *sessions.Session
-
-	// Проверяем, есть ли имя пользователя
-	if user != "" {
-		// Если есть, получаем сессию по имени пользователя
-		session, err = store.Get(r, user)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	} else {
-		// Если нет, создаем новую сессию без имени пользователя
-		session, err = store.New(r, "session-name")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	// Выбираем информацию об агентах из базы данных
-	rows, err := tx.Query("SELECT id, status, last_ping FROM agents WHERE user = ?", user)
+	rows, err := tx.Query("SELECT id, status, last_ping, capacity, load FROM agents WHERE user = ?", user)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Error querying agents: %v", err)
@@ -691,7 +704,7 @@ func agentsHandler(w http.ResponseWriter, r *http.Request) {
 	currentTime := time.Now()
 	for rows.Next() {
 		var agent AgentInfo
-		if err := rows.Scan(&agent.ID, &agent.Status, &agent.LastActive); err != nil {
+		if err := rows.Scan(&agent.ID, &agent.Status, &agent.LastActive, &agent.Capacity, &agent.Load); err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			log.Printf("Error scanning agent row: %v", err)
 			return
@@ -736,11 +749,15 @@ func agentsHandler(w http.ResponseWriter, r *http.Request) {
 	// Отображаем страницу агентов с информацией из базы данных
 	tmpl := template.Must(template.ParseFiles("frontend/agentsAndmain/agents.html"))
 	data := struct {
-		TimeoutStr string
-		Agents     []AgentInfo
+		TimeoutStr    string
+		Agents        []AgentInfo
+		Orgs          []Organization
+		CanAdminister bool
 	}{
-		TimeoutStr: timeoutStr,
-		Agents:     agents,
+		TimeoutStr:    timeoutStr,
+		Agents:        agents,
+		Orgs:          orgs,
+		CanAdminister: canAdmin,
 	}
 
 	// Убедитесь, что вызов WriteHeader делается только один раз
@@ -759,20 +776,44 @@ func agentsCreater(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := getCookieToken(r)
+	user, ok := formUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Агент организации входит в её общий пул, подключать агентов может оператор
+	orgID, err := formOrganization(r)
 	if err != nil {
-		log.Printf("Internal Server Error: %v", err)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if user == "" {
-		// Формируем ответ с токеном в формате JSON
-		response := map[string]string{"error": "Токен должен быть обязательным!"}
-		// Устанавливаем заголовок Content-Type и отправляем ответ
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	if err := authorizePool(user, orgID, RoleOperator); err != nil {
+		writeError(w, policyStatus(err), err.Error())
 		return
 	}
+	var orgName string
+	if orgID != 0 {
+		org, err := getOrganization(orgID, user)
+		if err != nil {
+			log.Printf("Error getting organization: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+		orgName = org.Name
+	}
 
-	agents.StartAgent(user)
+	// Агент регистрируется сразу с новым токеном пользователя, а работает в фоне, не блокируя обработчик
+	userToken, err := issueToken(user)
+	if err == nil {
+		err = agents.StartAgent(user, userToken, orgName)
+	}
+	if err != nil {
+		log.Printf("Error starting agent: %v", err)
+		response := map[string]string{"error": err.Error()}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	// Формируем ответ с токеном в формате JSON
 	response := map[string]string{"success": "Создан/Запущен агент."}
@@ -783,10 +824,18 @@ func agentsCreater(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// getExpressions возвращает выражения, отправленные пользователем
 func getExpressions(user string) ([]Expression, error) {
-	if user == "" {
-		return nil, fmt.Errorf("вы должны быть авторизованы")
-	}
+	return queryExpressions("user = ?", user)
+}
+
+// getOrganizationExpressions возвращает выражения, отправленные в организацию
+func getOrganizationExpressions(orgID int) ([]Expression, error) {
+	return queryExpressions("org_id = ?", orgID)
+}
+
+// queryExpressions возвращает выражения, подходящие под условие where с одним параметром
+func queryExpressions(where string, arg interface{}) ([]Expression, error) {
 	// Начинаем транзакцию
 	tx, err := db.Begin()
 	if err != nil {
@@ -795,7 +844,7 @@ func getExpressions(user string) ([]Expression, error) {
 	}
 	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 
-	rows, err := tx.Query("SELECT id, expression, result, status FROM expressions WHERE user = $1", user)
+	rows, err := tx.Query("SELECT "+expressionColumns+" FROM expressions WHERE "+where+" ORDER BY id", arg)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка выбора таблицы из базы данных: %v", err)
 	}
@@ -804,17 +853,10 @@ func getExpressions(user string) ([]Expression, error) {
 	var expressions []Expression
 	for rows.Next() {
 		var exp Expression
-		var result sql.NullInt64
-		if err := rows.Scan(&exp.ID, &exp.Expression, &result, &exp.Status); err != nil {
+		if err := exp.scan(rows); err != nil {
 			return nil, fmt.Errorf("ошибка при сканировании строк: %v", err)
 		}
-
-		// Если значение Result пустое, заменяем его на 0
-		if result.Valid {
-			exp.Result = int(result.Int64)
-		} else if !result.Valid {
-			exp.Result = 0 // Или любое другое значение по умолчанию
-		}
+		exp.Formatted = formatResult(exp.Result, resultDecimals)
 
 		expressions = append(expressions, exp)
 	}
@@ -832,123 +874,260 @@ func getExpressions(user string) ([]Expression, error) {
 	return expressions, nil
 }
 
-func HandleCalculateRequest(expression, user string, op1, op2, op3, op4, op5 int) (int, error) {
+// HandleCalculateRequest сохраняет выражение и ставит его операции в очередь задач.
+// Возвращает ID выражения, по которому клиент получает результат.
+// Если timeout не нулевой, выражение, не вычисленное за это время, завершается с ошибкой.
+// Все операции выражения вычисляются в режиме numeric со временем операций из профиля profile.
+// С выражением записываются имя профиля и время операций overrides, которое запрос задал поверх него,
+// по оператору или имени функции. Выражение x = 3*4 задаёт переменную x пользователя.
+// Выражение организации orgID вычисляет её пул агентов, orgID 0 — личные агенты пользователя.
+// prepared — выражение, уже разобранное prepareExpression на независимые операции.
+func HandleCalculateRequest(expression, user string, orgID int, timeout time.Duration, numeric expr.Numeric, profile Profile, overrides map[string]int, prepared *preparedExpression) (int, error) {
 	// Записываем выражение в базу данных
-	expressionID, isInSQL, isResultNoExist, err := saveExpression(expression, user)
+	expressionID, isInSQL, err := saveExpression(expression, user, orgID, timeout, numeric, profile, overrides, prepared)
 	if err != nil {
 		return 0, err
 	}
-	if isInSQL && !isResultNoExist {
-		resultReady, err := getOneExpression(expression, expressionID)
-		if err != nil {
-			return 0, err
-		}
-
-		return resultReady, nil
+	if isInSQL {
+		// Выражение уже посчитано или стоит в очереди
+		return expressionID, nil
 	}
 
-	// Отправляем выражение агенту для вычисления
-	result, err := computeExpression(expression, user, expressionID, op1, op2, op3, op4, op5)
-	if err != nil {
+	if err := enqueueExpression(expressionID, prepared.tree, numeric, prepared.bindings); err != nil {
 		return 0, err
 	}
 
-	// Обновляем результат вычисления в базе данных
-	err = updateExpressionResult(expressionID, result, "success")
-	if err != nil {
-		return 0, err
+	return expressionID, nil
+}
+
+// Колонки выражения в порядке полей, которые читает Expression.scan
+const expressionColumns = "id, expression, COALESCE(result_text, ''), status, COALESCE(error, ''), mode, precision, COALESCE(profile, ''), COALESCE(timing_overrides, ''), user, COALESCE(org_id, 0)"
+
+func (exp *Expression) scan(row interface{ Scan(...interface{}) error }) error {
+	var overrides string
+	err := row.Scan(&exp.ID, &exp.Expression, &exp.Result, &exp.Status, &exp.Error, &exp.Mode, &exp.Precision, &exp.Profile, &overrides, &exp.User, &exp.OrgID)
+	if err != nil || overrides == "" {
+		return err
 	}
+	return json.Unmarshal([]byte(overrides), &exp.TimingOverrides)
+}
 
-	return result, nil
+// getExpression возвращает выражение по ID. Права на него проверяет authorizeExpression.
+func getExpression(id int) (Expression, error) {
+	var exp Expression
+	err := exp.scan(db.QueryRow("SELECT "+expressionColumns+" FROM expressions WHERE id = ?", id))
+	if err != nil {
+		return exp, err
+	}
+	exp.Formatted = formatResult(exp.Result, resultDecimals)
+	return exp, nil
 }
 
-func getOneExpression(expr string, exprID int) (int, error) {
+// saveExpression записывает выражение вместе со значениями переменных и функциями, от которых оно зависит.
+// Присваивание переменной всегда записывается заново и становится её текущим выражением.
+func saveExpression(expression, user string, orgID int, timeout time.Duration, numeric expr.Numeric, profile Profile, overrides map[string]int, prepared *preparedExpression) (int, bool, error) {
+	variable := prepared.variable
+	timings := profile.Timings
 	// Начинаем транзакцию
 	tx, err := db.Begin()
 	if err != nil {
 		log.Printf("Error beginning transaction: %v", err)
-		return 0, err
+		return 0, false, err
 	}
 	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 
-	// Проверяем, нет ли уже результата в базе данных
-	rows, err := tx.Query("SELECT id, expression, result FROM expressions WHERE expression = ?", expr)
+	functionTimings, err := timingsJSON(timings.Functions)
+	if err != nil {
+		return 0, false, err
+	}
+	operatorTimings, err := timingsJSON(timings.Operators)
+	if err != nil {
+		return 0, false, err
+	}
+	timingOverrides, err := timingsJSON(overrides)
+	if err != nil {
+		return 0, false, err
+	}
+
+	variableBindings, err := bindingsJSON(prepared.bindings)
 	if err != nil {
-		return 0, fmt.Errorf("database error: %v", err)
+		return 0, false, err
+	}
+	definitions, err := bindingsJSON(prepared.definitions)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Проверяем, нет ли уже результата в базе данных. В другом режиме, с другими значениями переменных
+	// или текстами функций у выражения другой результат, с другим профилем — другое время вычисления,
+	// а выражение другого пула вычисляют другие агенты.
+	rows, err := tx.Query(`SELECT id, expression, status FROM expressions
+		WHERE expression = ? AND user = ? AND COALESCE(org_id, 0) = ? AND mode = ? AND precision = ?
+		AND COALESCE(bindings, '') = ? AND COALESCE(definitions, '') = ? AND COALESCE(profile, '') = ?
+		AND addition = ? AND subtraction = ? AND multiplication = ? AND division = ? AND exponent = ?
+		AND COALESCE(function_timings, '') = ? AND COALESCE(operator_timings, '') = ? AND COALESCE(timing_overrides, '') = ?`,
+		expression, user, orgID, numeric.Mode, numeric.Precision,
+		variableBindings.String, definitions.String, profile.Name,
+		timings.Addition, timings.Subtraction, timings.Multiplication, timings.Division, timings.Exponent,
+		functionTimings.String, operatorTimings.String, timingOverrides.String)
+	if err != nil {
+		return 0, false, fmt.Errorf("database error: %v", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var id int
-		var expression string
-		var result int
+		var express, status string
 
-		if err := rows.Scan(&id, &expression, &result); err != nil {
-			return 0, fmt.Errorf("error scanning row: %v ", err)
+		if err := rows.Scan(&id, &express, &status); err != nil {
+			return 0, false, fmt.Errorf("error scanning row: %v ", err)
 		}
 
-		if id == exprID && expression == expr {
-			return result, nil
+		if (status == "success" || status == "pending" || status == "processing") && express == expression && variable == "" {
+			return id, true, nil
 		}
 	}
+	rows.Close()
+
+	var deadline sql.NullTime
+	if timeout > 0 {
+		deadline = sql.NullTime{Time: time.Now().Add(timeout), Valid: true}
+	}
+
+	var assigned sql.NullString
+	if variable != "" {
+		assigned = sql.NullString{String: variable, Valid: true}
+	}
+
+	// Пишем выражение в базу данных и возвращаем его ID
+	res, err := tx.Exec("INSERT INTO expressions (expression, status, user, addition, subtraction, multiplication, division, exponent, deadline, timeout_ms, mode, precision, function_timings, operator_timings, variable, bindings, definitions, profile, timing_overrides, org_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		expression, "pending", user, timings.Addition, timings.Subtraction, timings.Multiplication, timings.Division, timings.Exponent, deadline, timeout.Milliseconds(), numeric.Mode, numeric.Precision, functionTimings, operatorTimings, assigned, variableBindings, definitions, profile.Name, timingOverrides, nullOrg(orgID))
+	if err != nil {
+		return 0, false, err
+	}
+	expressionID, err := res.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Новое выражение переменной заменяет прежнее, значение меняется, когда оно вычислится
+	if variable != "" {
+		_, err = tx.Exec(`INSERT INTO variables (user, name, expression_id) VALUES (?, ?, ?)
+			ON CONFLICT (user, name) DO UPDATE SET expression_id = excluded.expression_id`, user, variable, expressionID)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
 	// Заканчиваем транзакцию, фиксируя изменения
 	if err := tx.Commit(); err != nil {
 		log.Printf("Error committing transaction: %v", err)
-		return 0, err
+		return 0, false, err
 	}
 
-	return 0, nil
+	return int(expressionID), false, nil
 }
 
-func saveExpression(expression, user string) (int, bool, bool, error) {
-	// Начинаем транзакцию
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
-		return 0, false, false, err
+// timingsJSON записывает время функций или операторов JSON объектом, пустое время — NULL
+func timingsJSON(timings map[string]int) (sql.NullString, error) {
+	if len(timings) == 0 {
+		return sql.NullString{}, nil
 	}
-	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
-
-	// Проверяем, нет ли уже результата в базе данных
-	rows, err := tx.Query("SELECT id, expression, result, status FROM expressions WHERE expression = ? AND user = ?", expression, user)
+	data, err := json.Marshal(timings)
 	if err != nil {
-		return 0, false, false, fmt.Errorf("database error: %v", err)
+		return sql.NullString{}, err
 	}
-	defer rows.Close()
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
 
-	for rows.Next() {
-		var id int
-		var express, status string
-		var result sql.NullInt64
+func getAgent(id string) (Agent, error) {
+	var agent Agent
+	err := db.QueryRow("SELECT id, status, user, COALESCE(token_hash, ''), COALESCE(org_id, 0) FROM agents WHERE id = ?", id).
+		Scan(&agent.ID, &agent.Status, &agent.User, &agent.TokenHash, &agent.OrgID)
+	return agent, err
+}
 
-		if err := rows.Scan(&id, &express, &result, &status); err != nil {
-			return 0, false, false, fmt.Errorf("error scanning row: %v ", err)
-		}
+// hashToken возвращает хеш токена агента или refresh токена, в базе хранится только он
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
-		if status == "success" && express == expression {
-			return id, true, false, nil
-		} else if status == "pending" && express == expression {
-			return id, true, true, nil
-		}
+// validToken проверяет токен, выданный агенту при регистрации
+func (a Agent) validToken(token string) bool {
+	if a.TokenHash == "" || token == "" {
+		return false
 	}
+	return subtle.ConstantTimeCompare([]byte(a.TokenHash), []byte(hashToken(token))) == 1
+}
 
-	// Пишем выражение в базу данных и возвращаем его ID
-	res, err := tx.Exec("INSERT INTO expressions (expression, status, user) VALUES (?, ?, ?)", expression, "pending", user)
+// Самое длинное имя агента
+const maxAgentName = 64
+
+// checkAgentName проверяет имя агента. Имя показывается администраторам пула, пустое имя допустимо.
+func checkAgentName(name string) error {
+	if utf8.RuneCountInString(name) > maxAgentName {
+		return fmt.Errorf("имя агента длиннее %d символов", maxAgentName)
+	}
+	if strings.IndexFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-.", r)
+	}) >= 0 {
+		return errors.New("имя агента может состоять только из букв, цифр, _, - и .")
+	}
+	return nil
+}
+
+// registerAgent выдаёт агенту ID и новый токен. Агент с именем получает свою прежнюю запись,
+// безымянный агент занимает первую мёртвую безымянную запись пользователя в том же пуле или создаёт новую.
+// orgID — организация, в пул которой входит агент, 0 — личный агент.
+func registerAgent(user, name string, orgID int) (int, string, error) {
+	token, err := randomToken(32)
 	if err != nil {
-		return 0, false, false, err
+		return 0, "", err
 	}
-	expressionID, err := res.LastInsertId()
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
 	if err != nil {
-		return 0, false, false, err
+		log.Printf("Error beginning transaction: %v", err)
+		return 0, "", err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var id int
+	if name != "" {
+		err = tx.QueryRow("SELECT id FROM agents WHERE user = ? AND name = ?", user, name).Scan(&id)
+	} else {
+		err = tx.QueryRow("SELECT id FROM agents WHERE user = ? AND COALESCE(name, '') = '' AND COALESCE(org_id, 0) = ? AND status = 'dead' ORDER BY id LIMIT 1", user, orgID).Scan(&id)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := tx.Exec("INSERT INTO agents (name, status, user, token_hash, org_id) VALUES (?, ?, ?, ?, ?)", name, "dead", user, hashToken(token), nullOrg(orgID))
+		if err != nil {
+			return 0, "", err
+		}
+		newID, err := res.LastInsertId()
+		if err != nil {
+			return 0, "", err
+		}
+		id = int(newID)
+		log.Printf("Inserted new agent: ID=%d", id)
+	case err != nil:
+		return 0, "", err
+	default:
+		_, err = tx.Exec("UPDATE agents SET token_hash = ?, org_id = ? WHERE id = ?", hashToken(token), nullOrg(orgID), id)
+		if err != nil {
+			return 0, "", err
+		}
 	}
 
 	// Заканчиваем транзакцию, фиксируя изменения
 	if err := tx.Commit(); err != nil {
 		log.Printf("Error committing transaction: %v", err)
-		return 0, false, false, err
+		return 0, "", err
 	}
 
-	return int(expressionID), false, true, nil
+	return id, token, nil
 }
 
 func getAgentsFromDB() ([]Agent, error) {
@@ -960,7 +1139,7 @@ func getAgentsFromDB() ([]Agent, error) {
 	}
 	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 
-	rows, err := tx.Query("SELECT id, port, status, user FROM agents")
+	rows, err := tx.Query("SELECT id, status, user FROM agents")
 	if err != nil {
 		return nil, fmt.Errorf("error querying agents: %v", err)
 	}
@@ -969,7 +1148,7 @@ func getAgentsFromDB() ([]Agent, error) {
 	var agents []Agent
 	for rows.Next() {
 		var agent Agent
-		if err := rows.Scan(&agent.ID, &agent.Port, &agent.Status, &agent.User); err != nil {
+		if err := rows.Scan(&agent.ID, &agent.Status, &agent.User); err != nil {
 			return nil, fmt.Errorf("error scanning agent row: %v", err)
 		}
 		agents = append(agents, agent)
@@ -987,66 +1166,7 @@ func getAgentsFromDB() ([]Agent, error) {
 	return agents, nil
 }
 
-func computeExpression(expression, user string, id, op1, op2, op3, op4, op5 int) (int, error) {
-	agents, err := getAgentsFromDB()
-	if err != nil {
-		log.Fatalf("Error getting agents from database: %v", err)
-	}
-
-	port := 8081
-	found := false
-
-	// Перебираем список агентов
-	for _, agent := range agents {
-		// Проверяем статус агента
-		if agent.Status == "alive" && agent.User == user {
-			port = agent.Port
-			found = true
-		}
-	}
-	if !found {
-		return 0, fmt.Errorf("не найдено свободных агентов")
-	}
-
-	// Создаем клиент gRPC для подключения к агенту
-	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", port), grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("ошибка при наборе соединения с агентом: %v", err)
-	}
-	defer conn.Close()
-	client := agentrpc.NewAgentClient(conn)
-
-	// Создаем объект ExpressionRequest с выражением и временем выполнения операций
-	req := &agentrpc.ExpressionRequest{
-		Expression:     expression,
-		Addition:       int64(op1),
-		Subtraction:    int64(op2),
-		Multiplication: int64(op3),
-		Division:       int64(op4),
-		Exponent:       int64(op5),
-	}
-
-	// Вызываем метод CalculateExpression на агенте
-	resp, err := client.CalculateExpression(context.Background(), req)
-	if err != nil {
-		log.Fatalf("ошибка при вызове метода CalculateExpression: %v", err)
-	}
-
-	// Обновляем базу данных
-	err = updateExpressionResult(id, 0, "processing")
-	if err != nil {
-		return 0, fmt.Errorf("ошибка обновления базы данных: %v", err)
-	}
-
-	result, err := strconv.Atoi(resp.Result)
-	if err != nil {
-		return 0, fmt.Errorf("ошибка преобразования результата в число: %v", err)
-	}
-
-	return result, nil
-}
-
-func updateExpressionResult(expressionID int, result int, status string) error {
+func updateExpressionResult(expressionID int, result string, status string) error {
 	// Начинаем транзакцию
 	tx, err := db.Begin()
 	if err != nil {
@@ -1056,7 +1176,14 @@ func updateExpressionResult(expressionID int, result int, status string) error {
 	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
 
 	// Обновляем результат вычисления в базе данных
-	_, err = tx.Exec("UPDATE expressions SET result=?, status=? WHERE id=?", result, status, expressionID)
+	_, err = tx.Exec("UPDATE expressions SET result_text=?, status=? WHERE id=?", result, status, expressionID)
+	if err != nil {
+		return err
+	}
+	user, variable, err := storeVariable(tx, expressionID, result)
+	if err != nil {
+		return err
+	}
 
 	// Заканчиваем транзакцию, фиксируя изменения
 	if err := tx.Commit(); err != nil {
@@ -1064,44 +1191,31 @@ func updateExpressionResult(expressionID int, result int, status string) error {
 		return err
 	}
 
-	return err
-}
-
-func isValidExpression(expression string) bool {
-	// Проверяем наличие неизвестных символов
-	unknownSymbols := regexp.MustCompile(`[^0-9()+\-*/^.]`).FindAllString(expression, -1)
-	if len(unknownSymbols) > 0 {
-		fmt.Println("Выражение содержит неизвестные символы:", unknownSymbols)
-		return false
+	if variable != "" {
+		go reevaluateDependents(user, "bindings", variable)
 	}
+	return nil
+}
 
-	// Проверяем количество открывающих и закрывающих скобок
-	if strings.Count(expression, "(") != strings.Count(expression, ")") {
-		fmt.Println("Неправильное количество скобок")
-		return false
+// addColumn добавляет колонку в существующую таблицу, если её там ещё нет
+func addColumn(table, column, definition string) error {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
 	}
-
-	// Проверяем валидность выражения с помощью регулярного выражения
-	pattern := `-?\d+(\.\d+)?`
-	numbers := regexp.MustCompile(pattern).FindAllString(expression, -1)
-	for _, num := range numbers {
-		matched, err := regexp.MatchString("^"+pattern+"$", num)
-		if err != nil {
-			fmt.Println("Ошибка при выполнении регулярного выражения:", err)
-			return false
-		}
-		if !matched {
-			fmt.Println("Число", num, "невалидно")
-			return false
-		}
-	}
-
-	return true
+	return err
 }
 
 func initDB() {
+	// Путь к базе можно задать через DB_PATH, например чтобы хранить её в томе Docker.
+	// Агенты к базе не обращаются: они регистрируются через gRPC метод Register.
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		path = "expressions.db"
+	}
+
 	var err error
-	db, err = sql.Open("sqlite3", "expressions.db")
+	db, err = sql.Open("sqlite3", path+"?_busy_timeout=5000")
 	if err != nil {
 		log.Fatal("Error opening database:", err)
 	}
@@ -1112,6 +1226,19 @@ func main() {
 	// Создаем маршрутизатор HTTP запросов
 	mux := http.NewServeMux()
 
+	if err := loadRetryConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadResultConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAuthConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAdminConfig(); err != nil {
+		log.Fatal(err)
+	}
+
 	// Подключаемся к базе данных
 	initDB()
 	defer db.Close()
@@ -1123,27 +1250,152 @@ func main() {
 	}
 
 	// Создаем таблицу для хранения пользователей
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS Users (id INTEGER PRIMARY KEY AUTOINCREMENT, Name TEXT, password TEXT);")
-	if err != nil {
+	if err := createUsersTable(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	if err := createTokenTables(); err != nil {
 		log.Fatal("Error creating table:", err)
 	}
+	if err := loadSigningKeys(); err != nil {
+		log.Fatal("Error loading signing keys:", err)
+	}
 
-	_, err = db.Exec("CREATE TABLE agents (id INTEGER PRIMARY KEY AUTOINCREMENT, port INTEGER, last_ping TIMESTAMP DEFAULT CURRENT_TIMESTAMP, status	TEXT, user TEXT);")
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS agents (id INTEGER PRIMARY KEY AUTOINCREMENT, port INTEGER, last_ping TIMESTAMP DEFAULT CURRENT_TIMESTAMP, status	TEXT, user TEXT);")
 	if err != nil {
 		log.Fatal("Error creating table:", err)
 	}
 
+	// Время выполнения операций хранится вместе с выражением, чтобы задачи из очереди
+	// вычислялись с теми настройками, с которыми выражение было отправлено
+	for _, column := range []string{"addition", "subtraction", "multiplication", "division", "exponent"} {
+		if err := addColumn("expressions", column, "INTEGER DEFAULT 200"); err != nil {
+			log.Fatal("Error migrating table:", err)
+		}
+	}
+
+	// Срок вычисления выражения и причина, по которой оно завершилось с ошибкой
+	if err := addColumn("expressions", "deadline", "TIMESTAMP"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	// Сколько выражению отведено на вычисление: с этим сроком оно вычисляется заново,
+	// когда меняются его переменные. 0 — без срока, NULL у старых выражений — срок по умолчанию.
+	if err := addColumn("expressions", "timeout_ms", "INTEGER"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	if err := addColumn("expressions", "error", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+
+	// Результат хранится точной десятичной строкой, старые целые результаты переносим в неё
+	if err := addColumn("expressions", "result_text", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	if _, err := db.Exec("UPDATE expressions SET result_text = CAST(result AS TEXT) WHERE result IS NOT NULL AND result_text IS NULL"); err != nil {
+		log.Fatal("Error migrating results:", err)
+	}
+
+	// Режим вычислений выражения и точность big.Float, старые выражения считались во float64
+	if err := addColumn("expressions", "mode", "TEXT NOT NULL DEFAULT 'float64'"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	if err := addColumn("expressions", "precision", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+
+	// Время функций и остальных операторов выражения в виде JSON объектов {"sqrt": 100} и {"%": 100}
+	if err := addColumn("expressions", "function_timings", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	if err := addColumn("expressions", "operator_timings", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+
+	// Агент сообщает, сколько операций он может вычислять одновременно и сколько вычисляет сейчас
+	if err := addColumn("agents", "capacity", "INTEGER DEFAULT 1"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	if err := addColumn("agents", "load", "INTEGER DEFAULT 0"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	// Отдельно запущенный агент находит свою запись по имени
+	if err := addColumn("agents", "name", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+	// Хеш токена, выданного агенту при регистрации
+	if err := addColumn("agents", "token_hash", "TEXT"); err != nil {
+		log.Fatal("Error migrating table:", err)
+	}
+
+	// Создаем таблицу очереди задач
+	if err := createTasksTable(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	// Создаем таблицы переменных и функций пользователей
+	if err := createVariablesTable(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	if err := createFunctionsTable(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	if err := createProfilesTable(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	// Создаем таблицы организаций и их участников
+	if err := createOrganizationsTables(); err != nil {
+		log.Fatal("Error creating table:", err)
+	}
+	if err := restorePendingExpressions(); err != nil {
+		log.Fatal("Error restoring pending expressions:", err)
+	}
+
 	mux.HandleFunc("/", orchestrateHandler)
 	mux.HandleFunc("/login", loginHandler)
 	mux.HandleFunc("/loginCheck", loginCheckHandler)
 	mux.HandleFunc("/register", registHandler)
 	mux.HandleFunc("/registerCheck", registerCheckHandler)
+	mux.HandleFunc("/logout", logoutHandler)
 	mux.HandleFunc("/calculate", calcHandler)
+	mux.HandleFunc("/expression", expressionHandler)
 	mux.HandleFunc("/agents", agentsHandler)
 	mux.HandleFunc("/createAgents", agentsCreater)
+	mux.HandleFunc("/settings", settingsHandler)
+	mux.HandleFunc("/admin", adminHandler)
+
+	// JSON API для скриптов и CI
+	mux.HandleFunc("/api/v1/", apiNotFoundHandler)
+	mux.HandleFunc("/api/v1/auth/register", apiRegisterHandler)
+	mux.HandleFunc("/api/v1/auth/login", apiLoginHandler)
+	mux.HandleFunc("/api/v1/auth/refresh", apiRefreshHandler)
+	mux.HandleFunc("/api/v1/auth/logout", apiLogoutHandler)
+	mux.HandleFunc("/api/v1/expressions", apiExpressionsHandler)
+	mux.HandleFunc("/api/v1/expressions/", apiExpressionHandler)
+	mux.HandleFunc("/api/v1/agents", apiAgentsHandler)
+	mux.HandleFunc("/api/v1/variables", apiVariablesHandler)
+	mux.HandleFunc("/api/v1/variables/", apiVariableHandler)
+	mux.HandleFunc("/api/v1/functions", apiFunctionsHandler)
+	mux.HandleFunc("/api/v1/functions/", apiFunctionHandler)
+	mux.HandleFunc("/api/v1/profiles", apiProfilesHandler)
+	mux.HandleFunc("/api/v1/profiles/", apiProfileHandler)
+	mux.HandleFunc("/api/v1/orgs", apiOrganizationsHandler)
+	mux.HandleFunc("/api/v1/orgs/", apiOrganizationHandler)
+	mux.HandleFunc("/api/v1/admin/agents", apiAdminAgentsHandler)
+	mux.HandleFunc("/api/v1/admin/queues", apiAdminQueuesHandler)
+
+	// Создаем gRPC сервер. Keepalive обрывает потоки агентов, у которых пропала сеть,
+	// чтобы их задачи вернулись в очередь. Перехватчики пускают только агентов с верным токеном.
+	grpcOptions, err := grpcServerOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(append(grpcOptions, grpc.KeepaliveParams(keepalive.ServerParameters{
+		Time:    10 * time.Second,
+		Timeout: 5 * time.Second,
+	}))...)
 
-	// Создаем gRPC сервер
-	grpcServer := grpc.NewServer()
+	// Возвращаем в очередь задачи с истёкшей арендой и раздаём задачи подключённым агентам
+	go runLeaseReaper()
+	go runKeyRotation()
+	go runDispatcher()
 
 	// Увеличиваем счетчик WaitGroup для каждой горутины
 	wg.Add(2)
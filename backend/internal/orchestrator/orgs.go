@@ -0,0 +1,599 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Организации — команды пользователей с общим пулом агентов. Агент, зарегистрированный в организации,
+// вычисляет выражения, отправленные в неё любым участником, а личный агент — только личные выражения
+// своего пользователя. Права участника задаёт его роль:
+//   - viewer видит агентов, очередь и выражения организации;
+//   - operator вдобавок отправляет в неё выражения, отменяет их и подключает агентов к пулу;
+//   - admin вдобавок управляет участниками и видит организацию на странице администрирования.
+// Пользователи из ADMIN_USERS — администраторы всех организаций и видят всех агентов и все очереди.
+
+// Role — роль участника организации
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Самое длинное имя организации
+const maxOrganizationName = 64
+
+var (
+	errForbidden  = errors.New("недостаточно прав")
+	errNotMember  = errors.New("организация не найдена")
+	errOrgExists  = errors.New("организация с таким именем уже существует")
+	errLastAdmin  = errors.New("в организации должен остаться хотя бы один администратор")
+	errNoSuchUser = errors.New("пользователь не найден")
+)
+
+// Администраторы всего сервера
+var systemAdmins = map[string]bool{}
+
+// Organization — организация и роль в ней текущего пользователя
+type Organization struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Role    Role     `json:"role,omitempty"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Member — участник организации
+type Member struct {
+	User string `json:"user"`
+	Role Role   `json:"role"`
+}
+
+// rank возвращает место роли по возрастанию прав, 0 — не роль
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleOperator:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// allows сообщает, что роли r достаточно для действия, требующего роли need
+func (r Role) allows(need Role) bool {
+	return r.rank() > 0 && r.rank() >= need.rank()
+}
+
+// loadAdminConfig читает администраторов сервера из ADMIN_USERS: логины через запятую
+func loadAdminConfig() error {
+	for _, login := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			systemAdmins[login] = true
+		}
+	}
+	return nil
+}
+
+func isSystemAdmin(user string) bool {
+	return systemAdmins[user]
+}
+
+// createOrganizationsTables создаёт таблицы организаций и участников.
+// Агенты и выражения без организации — личные.
+func createOrganizationsTables() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS memberships (
+		org_id INTEGER NOT NULL,
+		user TEXT NOT NULL,
+		role TEXT NOT NULL,
+		PRIMARY KEY (org_id, user)
+	);`)
+	if err != nil {
+		return err
+	}
+	if err := addColumn("agents", "org_id", "INTEGER"); err != nil {
+		return err
+	}
+	return addColumn("expressions", "org_id", "INTEGER")
+}
+
+// nullOrg записывает личный ресурс (организация 0) как NULL
+func nullOrg(orgID int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(orgID), Valid: orgID != 0}
+}
+
+// memberRole возвращает роль пользователя в организации или "", если он в ней не состоит.
+// Если организации нет, возвращает errNotMember.
+func memberRole(orgID int, user string) (Role, error) {
+	var role string
+	err := db.QueryRow(`SELECT COALESCE(m.role, '') FROM organizations o
+		LEFT JOIN memberships m ON m.org_id = o.id AND m.user = ?
+		WHERE o.id = ?`, user, orgID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", errNotMember
+	}
+	if err != nil {
+		return "", err
+	}
+	if isSystemAdmin(user) {
+		return RoleAdmin, nil
+	}
+	return Role(role), nil
+}
+
+// authorize — единая проверка прав: может ли user выполнить действие, требующее роли need,
+// в организации orgID. Чужой организации для пользователя как будто нет: errNotMember, а не errForbidden.
+func authorize(user string, orgID int, need Role) error {
+	if orgID <= 0 {
+		return errNotMember
+	}
+	role, err := memberRole(orgID, user)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return errNotMember
+	}
+	if !role.allows(need) {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorizePool проверяет права пользователя на пул агентов и выражений: личный, если orgID равен 0,
+// с которым пользователь может всё, или пул организации orgID
+func authorizePool(user string, orgID int, need Role) error {
+	if orgID == 0 {
+		return nil
+	}
+	return authorize(user, orgID, need)
+}
+
+// authorizeExpression проверяет права пользователя на выражение: автор может с ним всё,
+// участники его организации — то, что позволяет роль need. Выражения, которого пользователь
+// не может видеть, для него нет: sql.ErrNoRows.
+func authorizeExpression(user string, id int, need Role) error {
+	var owner string
+	var orgID int
+	err := db.QueryRow("SELECT user, COALESCE(org_id, 0) FROM expressions WHERE id = ?", id).Scan(&owner, &orgID)
+	if err != nil {
+		return err
+	}
+	if owner == user || isSystemAdmin(user) {
+		return nil
+	}
+	if orgID == 0 {
+		return sql.ErrNoRows
+	}
+	err = authorize(user, orgID, need)
+	if err == errNotMember {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// policyStatus возвращает HTTP статус отказа в доступе
+func policyStatus(err error) int {
+	switch err {
+	case errNotMember, sql.ErrNoRows:
+		return http.StatusNotFound
+	case errForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// apiAuthorize проверяет права пользователя в организации или отвечает 403, 404 или 500
+func apiAuthorize(w http.ResponseWriter, user string, orgID int, need Role) bool {
+	err := authorize(user, orgID, need)
+	if err == nil {
+		return true
+	}
+	status := policyStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("Error checking access: %v", err)
+		writeError(w, status, "внутренняя ошибка сервера")
+		return false
+	}
+	writeError(w, status, err.Error())
+	return false
+}
+
+// checkOrganizationName проверяет имя новой организации
+func checkOrganizationName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("требуется имя организации")
+	}
+	if utf8.RuneCountInString(name) > maxOrganizationName {
+		return fmt.Errorf("имя организации длиннее %d символов", maxOrganizationName)
+	}
+	// Имя видят другие пользователи на страницах агентов и администрирования
+	if strings.IndexFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" _-.", r)
+	}) >= 0 {
+		return errors.New("имя организации может состоять только из букв, цифр, пробелов, _, - и .")
+	}
+	return nil
+}
+
+// createOrganization создаёт организацию, её создатель становится администратором
+func createOrganization(name, user string) (Organization, error) {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return Organization{}, err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	res, err := tx.Exec("INSERT INTO organizations (name) VALUES (?)", name)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return Organization{}, errOrgExists
+		}
+		return Organization{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Organization{}, err
+	}
+	_, err = tx.Exec("INSERT INTO memberships (org_id, user, role) VALUES (?, ?, ?)", id, user, RoleAdmin)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return Organization{}, err
+	}
+	return Organization{ID: int(id), Name: name, Role: RoleAdmin}, nil
+}
+
+// getOrganizations возвращает организации пользователя, а администратору сервера — все
+func getOrganizations(user string) ([]Organization, error) {
+	rows, err := db.Query(`SELECT o.id, o.name, COALESCE(m.role, '') FROM organizations o
+		LEFT JOIN memberships m ON m.org_id = o.id AND m.user = ?
+		WHERE m.user IS NOT NULL OR ?
+		ORDER BY o.name`, user, isSystemAdmin(user))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var org Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.Role); err != nil {
+			return nil, err
+		}
+		if isSystemAdmin(user) {
+			org.Role = RoleAdmin
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// operatorOrganizations возвращает организации, в которые пользователь может отправлять выражения
+// и подключать агентов
+func operatorOrganizations(user string) ([]Organization, error) {
+	orgs, err := getOrganizations(user)
+	if err != nil {
+		return nil, err
+	}
+	allowed := orgs[:0]
+	for _, org := range orgs {
+		if org.Role.allows(RoleOperator) {
+			allowed = append(allowed, org)
+		}
+	}
+	return allowed, nil
+}
+
+// formOrganization читает из формы ID организации, пустое значение — личные агенты
+func formOrganization(r *http.Request) (int, error) {
+	value := r.FormValue("org")
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, errors.New("невалидный ID организации")
+	}
+	return id, nil
+}
+
+// getOrganization возвращает организацию с её участниками и ролью пользователя
+func getOrganization(id int, user string) (Organization, error) {
+	org := Organization{ID: id, Members: []Member{}}
+	if err := db.QueryRow("SELECT name FROM organizations WHERE id = ?", id).Scan(&org.Name); err != nil {
+		return org, err
+	}
+	role, err := memberRole(id, user)
+	if err != nil {
+		return org, err
+	}
+	org.Role = role
+
+	rows, err := db.Query("SELECT user, role FROM memberships WHERE org_id = ? ORDER BY user", id)
+	if err != nil {
+		return org, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.User, &m.Role); err != nil {
+			return org, err
+		}
+		org.Members = append(org.Members, m)
+	}
+	return org, rows.Err()
+}
+
+// organizationID возвращает ID организации по имени или errNotMember
+func organizationID(name string) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT id FROM organizations WHERE name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNotMember
+	}
+	return id, err
+}
+
+// setMember добавляет пользователя в организацию или меняет его роль
+func setMember(orgID int, user string, role Role) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM Users WHERE Name = ?", user).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errNoSuchUser
+	}
+	if role != RoleAdmin {
+		if err := checkOtherAdmins(tx, orgID, user); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO memberships (org_id, user, role) VALUES (?, ?, ?)
+		ON CONFLICT (org_id, user) DO UPDATE SET role = excluded.role`, orgID, user, role)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// removeMember исключает пользователя из организации
+func removeMember(orgID int, user string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	if err := checkOtherAdmins(tx, orgID, user); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM memberships WHERE org_id = ? AND user = ?", orgID, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// checkOtherAdmins не даёт оставить организацию без администратора, когда user перестаёт им быть
+func checkOtherAdmins(tx *sql.Tx, orgID int, user string) error {
+	var others int
+	err := tx.QueryRow("SELECT COUNT(*) FROM memberships WHERE org_id = ? AND role = ? AND user != ?", orgID, RoleAdmin, user).Scan(&others)
+	if err != nil {
+		return err
+	}
+	var isAdmin int
+	err = tx.QueryRow("SELECT COUNT(*) FROM memberships WHERE org_id = ? AND role = ? AND user = ?", orgID, RoleAdmin, user).Scan(&isAdmin)
+	if err != nil {
+		return err
+	}
+	if isAdmin > 0 && others == 0 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// GET и POST /api/v1/orgs. Тело POST — {"name": "team"}.
+func apiOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if err := checkOrganizationName(req.Name); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		org, err := createOrganization(req.Name, user)
+		if err == errOrgExists {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating organization: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/v1/orgs/%d", org.ID))
+		writeJSON(w, http.StatusCreated, org)
+		return
+	}
+
+	orgs, err := getOrganizations(user)
+	if err != nil {
+		log.Printf("Error getting organizations: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, orgs)
+}
+
+// /api/v1/orgs/{id}, /api/v1/orgs/{id}/agents и /api/v1/orgs/{id}/members/{login}
+func apiOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/orgs/"), "/")
+	orgID, err := strconv.Atoi(parts[0])
+	if err != nil || orgID <= 0 {
+		writeError(w, http.StatusBadRequest, "невалидный ID организации")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		if !apiAuthorize(w, user, orgID, RoleViewer) {
+			return
+		}
+		org, err := getOrganization(orgID, user)
+		if err != nil {
+			log.Printf("Error getting organization: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+		writeJSON(w, http.StatusOK, org)
+	case len(parts) == 2 && parts[1] == "agents":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		if !apiAuthorize(w, user, orgID, RoleViewer) {
+			return
+		}
+		list, err := getOrganizationAgents(orgID)
+		if err != nil {
+			log.Printf("Error getting agents: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case len(parts) == 3 && parts[1] == "members" && parts[2] != "":
+		memberHandler(w, r, user, orgID, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "метод API не найден")
+	}
+}
+
+// PUT и DELETE /api/v1/orgs/{id}/members/{login}. Тело PUT — {"role": "operator"}.
+// Управляет участниками администратор, а выйти из организации может любой участник.
+func memberHandler(w http.ResponseWriter, r *http.Request, user string, orgID int, member string) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	need := RoleAdmin
+	if r.Method == http.MethodDelete && member == user {
+		need = RoleViewer
+	}
+	if !apiAuthorize(w, user, orgID, need) {
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodPut {
+		var req Member
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Role.rank() == 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("неизвестная роль %q, ожидается viewer, operator или admin", req.Role))
+			return
+		}
+		err = setMember(orgID, member, req.Role)
+		if err == nil {
+			writeJSON(w, http.StatusOK, Member{User: member, Role: req.Role})
+			return
+		}
+	} else {
+		err = removeMember(orgID, member)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	switch err {
+	case errNoSuchUser:
+		writeError(w, http.StatusNotFound, err.Error())
+	case sql.ErrNoRows:
+		writeError(w, http.StatusNotFound, "участник не найден")
+	case errLastAdmin:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("Error updating membership: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	agents "calc/backend/internal/agent"
+)
+
+// Имя профиля по умолчанию, пока пользователь не выбрал свой
+const defaultProfileName = "default"
+
+// Profile — именованный набор времени операций пользователя.
+// С профилем по умолчанию считаются выражения, для которых профиль не указан.
+type Profile struct {
+	Name    string         `json:"name"`
+	Timings agents.Timings `json:"timings"`
+	Default bool           `json:"default"`
+}
+
+// createProfilesTable создаёт таблицу профилей времени операций
+func createProfilesTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS timing_profiles (
+		user TEXT NOT NULL,
+		name TEXT NOT NULL,
+		timings TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user, name)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Профиль, с которым вычислялось выражение, и время операций, заданное поверх него в запросе
+	if err := addColumn("expressions", "profile", "TEXT"); err != nil {
+		return err
+	}
+	return addColumn("expressions", "timing_overrides", "TEXT")
+}
+
+// builtinProfile — профиль по умолчанию для пользователя, который не сохранил своего.
+// Функции и операторы агенты считают со своим временем по умолчанию.
+func builtinProfile() Profile {
+	return Profile{
+		Name: defaultProfileName,
+		Timings: agents.Timings{
+			Addition:       defaultOperationTime,
+			Subtraction:    defaultOperationTime,
+			Multiplication: defaultOperationTime,
+			Division:       defaultOperationTime,
+			Exponent:       defaultOperationTime,
+		},
+		Default: true,
+	}
+}
+
+// blankProfile — профиль, в который читается запрос. Время сложения и других основных операций,
+// которого нет в запросе, остаётся временем по умолчанию, а явный 0 сохраняется.
+func blankProfile() Profile {
+	return Profile{Timings: builtinProfile().Timings}
+}
+
+// checkProfile проверяет имя и время профиля
+func checkProfile(p Profile) error {
+	// Имя профиля — часть пути /api/v1/profiles/{name}
+	if p.Name == "" || strings.IndexFunc(p.Name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+	}) >= 0 {
+		return errors.New("имя профиля может состоять только из букв, цифр, _ и -")
+	}
+	timings := []int{p.Timings.Addition, p.Timings.Subtraction, p.Timings.Multiplication, p.Timings.Division, p.Timings.Exponent}
+	for _, t := range timings {
+		if t < 0 {
+			return errors.New("время операций не может быть отрицательным")
+		}
+	}
+	return p.Timings.CheckCosts()
+}
+
+// scanProfile читает профиль из строки результата запроса
+func scanProfile(row interface{ Scan(...interface{}) error }) (Profile, error) {
+	var p Profile
+	var timings string
+	if err := row.Scan(&p.Name, &timings, &p.Default); err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal([]byte(timings), &p.Timings); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// loadProfile возвращает профиль пользователя по имени, а если имя пустое — профиль по умолчанию.
+// Профиль default есть всегда: если пользователь не сохранил свой, это встроенный профиль.
+// Если профиля нет, возвращается sql.ErrNoRows.
+func loadProfile(user, name string) (Profile, error) {
+	var p Profile
+	var err error
+	if name == "" {
+		p, err = scanProfile(db.QueryRow("SELECT name, timings, is_default FROM timing_profiles WHERE user = ? AND is_default = 1", user))
+	} else {
+		p, err = scanProfile(db.QueryRow("SELECT name, timings, is_default FROM timing_profiles WHERE user = ? AND name = ?", user, name))
+	}
+	if err != sql.ErrNoRows {
+		return p, err
+	}
+	switch name {
+	case "":
+		// Пока ни один профиль не отмечен, по умолчанию используется профиль default
+		p, err = loadProfile(user, defaultProfileName)
+		p.Default = true
+		return p, err
+	case defaultProfileName:
+		// Встроенный профиль остаётся доступным по имени, даже если по умолчанию выбран другой
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM timing_profiles WHERE user = ? AND is_default = 1", user).Scan(&count); err != nil {
+			return p, err
+		}
+		p = builtinProfile()
+		p.Default = count == 0
+		return p, nil
+	}
+	return p, sql.ErrNoRows
+}
+
+// getProfiles возвращает профили пользователя, включая встроенный профиль default, если он не переопределён
+func getProfiles(user string) ([]Profile, error) {
+	rows, err := db.Query("SELECT name, timings, is_default FROM timing_profiles WHERE user = ? ORDER BY name", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := []Profile{}
+	var hasDefault, hasBuiltin bool
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		hasDefault = hasDefault || p.Default
+		hasBuiltin = hasBuiltin || p.Name == defaultProfileName
+		profiles = append(profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if !hasBuiltin {
+		builtin := builtinProfile()
+		builtin.Default = false
+		profiles = append([]Profile{builtin}, profiles...)
+	}
+	if !hasDefault {
+		for i := range profiles {
+			profiles[i].Default = profiles[i].Name == defaultProfileName
+		}
+	}
+	return profiles, nil
+}
+
+// saveProfile сохраняет проверенный checkProfile профиль или заменяет прежний с тем же именем.
+// Профиль по умолчанию у пользователя один: новый снимает отметку с прежнего.
+func saveProfile(user string, p Profile) (Profile, error) {
+	timings, err := json.Marshal(p.Timings)
+	if err != nil {
+		return p, err
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return p, err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	if p.Default {
+		if _, err := tx.Exec("UPDATE timing_profiles SET is_default = 0 WHERE user = ?", user); err != nil {
+			return p, err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO timing_profiles (user, name, timings, is_default) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user, name) DO UPDATE SET timings = excluded.timings, is_default = excluded.is_default`, user, p.Name, string(timings), p.Default)
+	if err != nil {
+		return p, err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return p, err
+	}
+	return p, nil
+}
+
+// deleteProfile удаляет профиль. Выражения сохраняют имя профиля и время, с которым они вычислялись,
+// а если удалён профиль по умолчанию, им снова становится встроенный профиль default.
+func deleteProfile(user, name string) error {
+	res, err := db.Exec("DELETE FROM timing_profiles WHERE user = ? AND name = ?", user, name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GET и POST /api/v1/profiles. Тело POST — профиль {"name": "fast", "timings": {"addition": 10}, "default": true}.
+func apiProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		p := blankProfile()
+		if !decodeJSON(w, r, &p) {
+			return
+		}
+		writeProfile(w, user, p, http.StatusCreated)
+		return
+	}
+
+	profiles, err := getProfiles(user)
+	if err != nil {
+		log.Printf("Error getting profiles: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+// writeProfile сохраняет профиль и отвечает им со статусом status
+func writeProfile(w http.ResponseWriter, user string, p Profile, status int) {
+	if err := checkProfile(p); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, err := saveProfile(user, p)
+	if err != nil {
+		log.Printf("Error saving profile: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/profiles/"+p.Name)
+	writeJSON(w, status, p)
+}
+
+// GET, PUT и DELETE /api/v1/profiles/{name}
+func apiProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/profiles/")
+	switch r.Method {
+	case http.MethodPut:
+		p := blankProfile()
+		if !decodeJSON(w, r, &p) {
+			return
+		}
+		p.Name = name
+		writeProfile(w, user, p, http.StatusOK)
+	case http.MethodDelete:
+		err := deleteProfile(user, name)
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "профиль не найден")
+		case err != nil:
+			log.Printf("Error deleting profile: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		p, err := loadProfile(user, name)
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "профиль не найден")
+		case err != nil:
+			log.Printf("Error getting profile: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		default:
+			writeJSON(w, http.StatusOK, p)
+		}
+	}
+}
+
+// FunctionTimings возвращает время функций профиля строкой вида "sqrt=100, sin=300"
+func (p Profile) FunctionTimings() string {
+	return timingsText(p.Timings.Functions)
+}
+
+// OperatorTimings возвращает время операторов профиля строкой вида "%=100, <==50"
+func (p Profile) OperatorTimings() string {
+	return timingsText(p.Timings.Operators)
+}
+
+func timingsText(timings map[string]int) string {
+	names := make([]string, 0, len(timings))
+	for name := range timings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Itoa(timings[name])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// Страница настроек: профили времени операций пользователя.
+// POST сохраняет профиль из формы и возвращает на страницу настроек.
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := pageUser(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		p, err := formProfile(r)
+		if err == nil {
+			err = checkProfile(p)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := saveProfile(user, p); err != nil {
+			log.Printf("Error saving profile: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profiles, err := getProfiles(user)
+	if err != nil {
+		log.Printf("Error getting profiles: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("frontend/agentsAndmain/settings.html"))
+	data := struct {
+		Profiles []Profile
+	}{
+		Profiles: profiles,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		log.Printf("Error executing template: %v", err)
+	}
+}
+
+// formProfile читает профиль из формы страницы настроек. Пустое время — время по умолчанию.
+func formProfile(r *http.Request) (Profile, error) {
+	p := blankProfile()
+	p.Name, p.Default = r.FormValue("name"), r.FormValue("default") != ""
+	fields := []struct {
+		name  string
+		title string
+		value *int
+	}{
+		{"addition", "сложения", &p.Timings.Addition},
+		{"subtraction", "вычитания", &p.Timings.Subtraction},
+		{"multiplication", "умножения", &p.Timings.Multiplication},
+		{"division", "деления", &p.Timings.Division},
+		{"exponent", "степени", &p.Timings.Exponent},
+	}
+	for _, field := range fields {
+		value := r.FormValue(field.name)
+		if value == "" {
+			continue
+		}
+		ms, err := strconv.Atoi(value)
+		if err != nil {
+			return p, fmt.Errorf("невалидное время %s", field.title)
+		}
+		*field.value = ms
+	}
+
+	// Время функций и операторов необязательно, например "sqrt=100, sin=300" и "%=100, <==50"
+	functions, err := agents.ParseFunctionTimings(r.FormValue("functions"))
+	if err != nil {
+		return p, err
+	}
+	operators, err := agents.ParseOperatorTimings(r.FormValue("operators"))
+	if err != nil {
+		return p, err
+	}
+	p.Timings.SetFunctions(functions)
+	p.Timings.SetOperators(operators)
+	return p, nil
+}
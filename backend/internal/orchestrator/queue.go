@@ -0,0 +1,700 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	agents "calc/backend/internal/agent"
+	"calc/backend/internal/expr"
+)
+
+// Через сколько аренда задачи истекает и задача возвращается в очередь
+const leaseTimeout = 30 * time.Second
+
+// Как часто проверяются просроченные аренды
+const reapInterval = time.Second
+
+// Политика повторов и срок вычисления, переопределяются переменными окружения в loadRetryConfig
+var (
+	// Сколько раз задача выдаётся агентам, прежде чем выражение получит статус error
+	maxTaskAttempts = 3
+	// Пауза перед первым повтором, дальше она удваивается
+	retryBackoff = time.Second
+	// Срок вычисления выражения, если пользователь не указал свой; 0 — без срока
+	expressionTimeout = 5 * time.Minute
+)
+
+var errLeaseLost = errors.New("аренда задачи истекла или принадлежит другому агенту")
+
+var errExpressionFinished = errors.New("выражение уже вычислено или отменено")
+
+// Task — одна бинарная операция или вызов функции из очереди задач
+type Task struct {
+	ID           int
+	ExpressionID int
+	Operation    string
+	Arg1         string
+	Arg2         string
+	Mode         string
+	Precision    int
+	// Время операций. Функции и операторы без времени агент считает со своим временем по умолчанию.
+	Timings agents.Timings
+	// Значения переменных и определения функций пользователя, с которыми вычисляется выражение
+	Variables   map[string]string
+	Definitions map[string]string
+}
+
+// Expression возвращает операцию в виде выражения для агента
+func (t Task) Expression() string {
+	return nodeTask(t.Operation, t.Arg1, t.Arg2)
+}
+
+// loadRetryConfig читает TASK_MAX_ATTEMPTS, TASK_RETRY_BACKOFF и EXPRESSION_TIMEOUT
+func loadRetryConfig() error {
+	if value := os.Getenv("TASK_MAX_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("TASK_MAX_ATTEMPTS должно быть положительным целым числом, получено %q", value)
+		}
+		maxTaskAttempts = n
+	}
+	durations := map[string]*time.Duration{
+		"TASK_RETRY_BACKOFF": &retryBackoff,
+		"EXPRESSION_TIMEOUT": &expressionTimeout,
+	}
+	for name, field := range durations {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s должно быть длительностью, например 30s, получено %q", name, value)
+		}
+		*field = d
+	}
+	return nil
+}
+
+func createTasksTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS tasks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		expression_id INTEGER,
+		parent_id INTEGER,
+		side TEXT,
+		operation TEXT,
+		arg1 TEXT,
+		arg2 TEXT,
+		status TEXT,
+		agent_id INTEGER,
+		lease_until TIMESTAMP,
+		result TEXT
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Номер попытки, время, раньше которого задачу нельзя выдавать, и агент, на котором она не удалась
+	if err := addColumn("tasks", "attempts", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumn("tasks", "not_before", "TIMESTAMP"); err != nil {
+		return err
+	}
+	return addColumn("tasks", "failed_agent", "INTEGER")
+}
+
+// enqueueExpression кладёт операции дерева выражения в очередь задач.
+// Операции, у которых готовы оба операнда, сразу получают статус queued,
+// остальные ждут (waiting) результатов своих потомков. bindings — значения переменных выражения.
+func enqueueExpression(expressionID int, tree *node, numeric expr.Numeric, bindings map[string]string) error {
+	// Выражение из одного числа или константы вычислять на агенте не нужно,
+	// достаточно записать его значение в виде режима
+	if tree.isLeaf() {
+		leaf, err := expr.Parse(tree.value)
+		if err != nil {
+			return err
+		}
+		result, err := numeric.EvalWith(leaf, expr.Env{Vars: bindings})
+		if err != nil {
+			return failExpression(expressionID, err.Error())
+		}
+		return updateExpressionResult(expressionID, result, "success")
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	if err := insertTask(tx, expressionID, tree, sql.NullInt64{}, ""); err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func insertTask(tx *sql.Tx, expressionID int, n *node, parentID sql.NullInt64, side string) error {
+	var arg1, arg2 sql.NullString
+	if n.op == subtreeOperation {
+		// Поддерево отправляется агенту целиком, его текст хранится вместо первого операнда
+		arg1 = sql.NullString{String: n.value, Valid: true}
+	} else if n.left.isLeaf() {
+		arg1 = sql.NullString{String: n.left.value, Valid: true}
+	}
+	// У функции одного аргумента второй операнд пустой и известен сразу
+	if n.right == nil {
+		arg2 = sql.NullString{Valid: true}
+	} else if n.right.isLeaf() {
+		arg2 = sql.NullString{String: n.right.value, Valid: true}
+	}
+
+	status := "waiting"
+	if arg1.Valid && arg2.Valid {
+		status = "queued"
+	}
+
+	res, err := tx.Exec("INSERT INTO tasks (expression_id, parent_id, side, operation, arg1, arg2, status) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		expressionID, parentID, side, n.op, arg1, arg2, status)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	self := sql.NullInt64{Int64: id, Valid: true}
+	if n.left != nil && !n.left.isLeaf() {
+		if err := insertTask(tx, expressionID, n.left, self, "left"); err != nil {
+			return err
+		}
+	}
+	if n.right != nil && !n.right.isLeaf() {
+		if err := insertTask(tx, expressionID, n.right, self, "right"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaseTask выдаёт агенту самую старую свободную задачу его пула: личному агенту — из личных выражений
+// его пользователя, агенту организации — из выражений организации. Возвращает nil, если свободных задач нет.
+// Агент организации получает задачи, только пока его пользователь остаётся в ней оператором,
+// иначе leaseTask возвращает errNotMember или errForbidden.
+func leaseTask(agent Agent) (*Task, error) {
+	if err := authorizePool(agent.User, agent.OrgID, RoleOperator); err != nil {
+		return nil, err
+	}
+
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return nil, err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	// Задачу, которая не удалась на этом агенте, отдаём ему, только если других агентов нет
+	var task Task
+	var functions, operators, bindings, definitions string
+	err = tx.QueryRow(`SELECT t.id, t.expression_id, t.operation, t.arg1, t.arg2,
+			e.addition, e.subtraction, e.multiplication, e.division, e.exponent, e.mode, e.precision,
+			COALESCE(e.function_timings, ''), COALESCE(e.operator_timings, ''), COALESCE(e.bindings, ''), COALESCE(e.definitions, '')
+		FROM tasks t JOIN expressions e ON e.id = t.expression_id
+		WHERE t.status = 'queued'
+		AND CASE WHEN ? = 0 THEN e.org_id IS NULL AND e.user = ? ELSE e.org_id = ? END
+		AND (t.not_before IS NULL OR t.not_before <= ?)
+		AND (? OR t.failed_agent IS NULL OR t.failed_agent != ?)
+		ORDER BY t.id LIMIT 1`, agent.OrgID, agent.User, agent.OrgID, time.Now(), !othersConnected(agent), agent.ID).Scan(&task.ID, &task.ExpressionID, &task.Operation, &task.Arg1, &task.Arg2,
+		&task.Timings.Addition, &task.Timings.Subtraction, &task.Timings.Multiplication, &task.Timings.Division, &task.Timings.Exponent, &task.Mode, &task.Precision,
+		&functions, &operators, &bindings, &definitions)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error selecting task: %v", err)
+	}
+	if functions != "" {
+		if err := json.Unmarshal([]byte(functions), &task.Timings.Functions); err != nil {
+			return nil, fmt.Errorf("error decoding function timings: %v", err)
+		}
+	}
+	if operators != "" {
+		if err := json.Unmarshal([]byte(operators), &task.Timings.Operators); err != nil {
+			return nil, fmt.Errorf("error decoding operator timings: %v", err)
+		}
+	}
+	task.Variables, err = decodeBindings(bindings)
+	if err != nil {
+		return nil, err
+	}
+	task.Definitions, err = decodeBindings(definitions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Задачу между выборкой и обновлением мог забрать другой агент, тогда она уже не в очереди
+	res, err := tx.Exec("UPDATE tasks SET status = 'leased', agent_id = ?, lease_until = ?, attempts = attempts + 1 WHERE id = ? AND status = 'queued'",
+		agent.ID, time.Now().Add(leaseTimeout), task.ID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n != 1 {
+		return nil, nil
+	}
+	_, err = tx.Exec("UPDATE expressions SET status = 'processing' WHERE id = ? AND status = 'pending'", task.ExpressionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// completeTask сохраняет результат задачи и передаёт его родительской операции.
+// Если задача была корнем дерева, результат записывается в выражение.
+func completeTask(taskID, agentID int, result string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var expressionID int
+	var parentID, owner sql.NullInt64
+	var side, status string
+	err = tx.QueryRow("SELECT expression_id, parent_id, side, status, agent_id FROM tasks WHERE id = ?", taskID).
+		Scan(&expressionID, &parentID, &side, &status, &owner)
+	if err != nil {
+		return fmt.Errorf("error selecting task: %v", err)
+	}
+	if status != "leased" || !owner.Valid || int(owner.Int64) != agentID {
+		return errLeaseLost
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET status = 'done', result = ? WHERE id = ?", result, taskID)
+	if err != nil {
+		return err
+	}
+
+	if parentID.Valid {
+		column := "arg1"
+		if side == "right" {
+			column = "arg2"
+		}
+		_, err = tx.Exec("UPDATE tasks SET "+column+" = ? WHERE id = ?", result, parentID.Int64)
+		if err != nil {
+			return err
+		}
+		// Родитель готов к вычислению, когда известны оба операнда
+		_, err = tx.Exec("UPDATE tasks SET status = 'queued' WHERE id = ? AND status = 'waiting' AND arg1 IS NOT NULL AND arg2 IS NOT NULL", parentID.Int64)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.Exec("UPDATE expressions SET result_text = ?, status = 'success' WHERE id = ?", result, expressionID)
+		if err != nil {
+			return err
+		}
+	}
+	// Результат присваивания становится значением переменной
+	var user, variable string
+	if !parentID.Valid {
+		user, variable, err = storeVariable(tx, expressionID, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	// Выражения, которые зависят от изменившейся переменной, вычисляются заново
+	if variable != "" {
+		go reevaluateDependents(user, "bindings", variable)
+	}
+	return nil
+}
+
+// failTask завершает выражение с ошибкой вычисления, которую вернул агент.
+// Деление на ноль или выход из области определения повторятся на любом агенте,
+// поэтому такие задачи не повторяются: в очередь возвращаются только задачи
+// с истёкшей арендой и задачи пропавших агентов.
+func failTask(taskID, agentID int, reason string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var owner sql.NullInt64
+	var status string
+	var expressionID int
+	err = tx.QueryRow("SELECT status, agent_id, expression_id FROM tasks WHERE id = ?", taskID).Scan(&status, &owner, &expressionID)
+	if err != nil {
+		return fmt.Errorf("error selecting task: %v", err)
+	}
+	if status != "leased" || !owner.Valid || int(owner.Int64) != agentID {
+		return errLeaseLost
+	}
+
+	stopped, err := failExpressionTx(tx, expressionID, reason)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	cancelTasks(stopped, "выражение завершилось с ошибкой")
+	return nil
+}
+
+// retryTask возвращает задачу в очередь с паузой, которая удваивается с каждой попыткой.
+// Агент, на котором задача не удалась, получит её снова, только если других агентов нет.
+// Когда попытки кончились, выражение получает статус error, а функция возвращает
+// задачи выражения, которые нужно отменить на агентах.
+func retryTask(tx *sql.Tx, taskID, agentID int, reason string) (map[int]int, error) {
+	var expressionID, attempts int
+	err := tx.QueryRow("SELECT expression_id, attempts FROM tasks WHERE id = ?", taskID).Scan(&expressionID, &attempts)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting task: %v", err)
+	}
+
+	if attempts >= maxTaskAttempts {
+		log.Printf("Task %d failed %d times, giving up: %s", taskID, attempts, reason)
+		return failExpressionTx(tx, expressionID, fmt.Sprintf("%s (попыток: %d)", reason, attempts))
+	}
+
+	if attempts < 1 {
+		attempts = 1
+	}
+	notBefore := time.Now().Add(retryBackoff << (attempts - 1))
+	_, err = tx.Exec("UPDATE tasks SET status = 'queued', agent_id = NULL, lease_until = NULL, not_before = ?, failed_agent = ? WHERE id = ?",
+		notBefore, agentID, taskID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Task %d will be retried after %s: %s", taskID, notBefore.Format(time.RFC3339), reason)
+	return nil, nil
+}
+
+// failExpression помечает выражение ошибочным с указанной причиной,
+// снимает его задачи с очереди и останавливает их на агентах
+func failExpression(expressionID int, reason string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	stopped, err := failExpressionTx(tx, expressionID, reason)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	cancelTasks(stopped, reason)
+	return nil
+}
+
+// failExpressionTx — failExpression внутри уже открытой транзакции.
+// Возвращает задачи выражения, которые ещё вычисляют агенты.
+func failExpressionTx(tx *sql.Tx, expressionID int, reason string) (map[int]int, error) {
+	leased, err := leasedTasks(tx, "SELECT id, agent_id FROM tasks WHERE expression_id = ? AND status = 'leased'", expressionID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET status = 'failed' WHERE expression_id = ? AND status != 'done'", expressionID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE expressions SET status = 'error', error = ? WHERE id = ? AND status IN ('pending', 'processing')", reason, expressionID)
+	if err != nil {
+		return nil, err
+	}
+	return leased, nil
+}
+
+// leasedTasks выбирает задачи в аренде запросом, возвращающим id и agent_id:
+// ID задачи → ID агента, который её вычисляет
+func leasedTasks(tx *sql.Tx, query string, args ...interface{}) (map[int]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leased := make(map[int]int)
+	for rows.Next() {
+		var taskID, agentID int
+		if err := rows.Scan(&taskID, &agentID); err != nil {
+			return nil, err
+		}
+		leased[taskID] = agentID
+	}
+	return leased, rows.Err()
+}
+
+// cancelExpression отменяет ещё не вычисленное выражение и просит агентов прекратить вычисление
+// его задач. Права на отмену проверяет authorizeExpression.
+func cancelExpression(expressionID int) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var status string
+	err = tx.QueryRow("SELECT status FROM expressions WHERE id = ?", expressionID).Scan(&status)
+	if err != nil {
+		return err
+	}
+	if status != "pending" && status != "processing" {
+		return errExpressionFinished
+	}
+
+	leased, err := leasedTasks(tx, "SELECT id, agent_id FROM tasks WHERE expression_id = ? AND status = 'leased'", expressionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET status = 'cancelled' WHERE expression_id = ? AND status != 'done'", expressionID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE expressions SET status = 'cancelled' WHERE id = ?", expressionID)
+	if err != nil {
+		return err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	cancelTasks(leased, "выражение отменено пользователем")
+	return nil
+}
+
+// requeueExpiredTasks возвращает в очередь задачи с истёкшей арендой
+// и просит агентов, которые их держали, прекратить вычисление
+func requeueExpiredTasks() error {
+	expired, stopped, err := retryLeasedTasks("аренда задачи истекла",
+		"SELECT id, agent_id FROM tasks WHERE status = 'leased' AND lease_until < ?", time.Now())
+	if err != nil {
+		return err
+	}
+	if len(expired) > 0 {
+		log.Printf("Returned %d expired tasks to the queue", len(expired))
+	}
+
+	cancelTasks(expired, "аренда задачи истекла")
+	cancelTasks(stopped, "выражение завершилось с ошибкой")
+	return nil
+}
+
+// releaseAgentTasks сразу возвращает в очередь задачи отключившегося агента
+func releaseAgentTasks(agentID int) error {
+	_, stopped, err := retryLeasedTasks("агент отключился",
+		"SELECT id, agent_id FROM tasks WHERE status = 'leased' AND agent_id = ?", agentID)
+	if err != nil {
+		return err
+	}
+	cancelTasks(stopped, "выражение завершилось с ошибкой")
+	return nil
+}
+
+// releaseTask сразу возвращает в очередь задачу, которая не дошла до агента
+func releaseTask(taskID, agentID int) error {
+	_, stopped, err := retryLeasedTasks("задача не дошла до агента",
+		"SELECT id, agent_id FROM tasks WHERE status = 'leased' AND id = ? AND agent_id = ?", taskID, agentID)
+	if err != nil {
+		return err
+	}
+	cancelTasks(stopped, "выражение завершилось с ошибкой")
+	return nil
+}
+
+// retryLeasedTasks отправляет на повтор задачи в аренде, выбранные запросом.
+// Возвращает эти задачи и задачи выражений, у которых кончились попытки.
+func retryLeasedTasks(reason, query string, args ...interface{}) (map[int]int, map[int]int, error) {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return nil, nil, err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	leased, err := leasedTasks(tx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	stopped := make(map[int]int)
+	for taskID, agentID := range leased {
+		if _, ok := stopped[taskID]; ok {
+			// Выражение задачи уже завершилось с ошибкой
+			continue
+		}
+		failed, err := retryTask(tx, taskID, agentID, reason)
+		if err != nil {
+			return nil, nil, err
+		}
+		for id, agent := range failed {
+			stopped[id] = agent
+		}
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return nil, nil, err
+	}
+
+	return leased, stopped, nil
+}
+
+// expireExpressions завершает с ошибкой выражения, срок вычисления которых истёк
+func expireExpressions() error {
+	rows, err := db.Query("SELECT id FROM expressions WHERE status IN ('pending', 'processing') AND deadline IS NOT NULL AND deadline < ?", time.Now())
+	if err != nil {
+		return err
+	}
+	var expired []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+
+	for _, id := range expired {
+		log.Printf("Expression %d missed its deadline", id)
+		if err := failExpression(id, "истёк срок вычисления выражения"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendLease продлевает аренду задачи, пока агент сообщает о прогрессе
+func extendLease(taskID, agentID int) error {
+	_, err := db.Exec("UPDATE tasks SET lease_until = ? WHERE id = ? AND agent_id = ? AND status = 'leased'", time.Now().Add(leaseTimeout), taskID, agentID)
+	return err
+}
+
+// restorePendingExpressions ставит в очередь выражения, сохранённые до появления очереди задач
+func restorePendingExpressions() error {
+	rows, err := db.Query(`SELECT id, expression, mode, precision, COALESCE(bindings, '') FROM expressions
+		WHERE status IN ('pending', 'processing')
+		AND NOT EXISTS (SELECT 1 FROM tasks WHERE tasks.expression_id = expressions.id)`)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		id         int
+		expression string
+		mode       string
+		precision  int
+		bindings   string
+	}
+	var expressions []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.expression, &p.mode, &p.precision, &p.bindings); err != nil {
+			rows.Close()
+			return err
+		}
+		expressions = append(expressions, p)
+	}
+	rows.Close()
+
+	for _, p := range expressions {
+		numeric, err := newNumeric(p.mode, p.precision)
+		if err != nil {
+			failExpression(p.id, err.Error())
+			continue
+		}
+		tree, err := parseTree(p.expression, numeric)
+		if err != nil {
+			log.Printf("Error parsing stored expression %d: %v", p.id, err)
+			failExpression(p.id, err.Error())
+			continue
+		}
+		// Выражение вычисляется с теми значениями переменных, с которыми было поставлено в очередь
+		bindings, err := decodeBindings(p.bindings)
+		if err != nil {
+			failExpression(p.id, err.Error())
+			continue
+		}
+		if err := enqueueExpression(p.id, tree, numeric, bindings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runLeaseReaper периодически возвращает в очередь задачи, агенты которых не прислали результат,
+// и завершает выражения с истёкшим сроком
+func runLeaseReaper() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := requeueExpiredTasks(); err != nil {
+			log.Printf("Error requeueing expired tasks: %v", err)
+		}
+		if err := expireExpressions(); err != nil {
+			log.Printf("Error expiring expressions: %v", err)
+		}
+	}
+}
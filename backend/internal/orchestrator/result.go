@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+)
+
+// Сколько знаков после точки показывать в результате, -1 — показывать точное значение.
+// Задаётся переменной окружения RESULT_DECIMALS, в API — параметром запроса decimals.
+var resultDecimals = -1
+
+// loadResultConfig читает RESULT_DECIMALS
+func loadResultConfig() error {
+	value := os.Getenv("RESULT_DECIMALS")
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < -1 {
+		return fmt.Errorf("RESULT_DECIMALS должно быть числом от -1, получено %q", value)
+	}
+	resultDecimals = n
+	return nil
+}
+
+// formatResult округляет десятичный результат до decimals знаков после точки.
+// Значения, которые не разбираются как десятичное число, возвращаются как есть.
+func formatResult(value string, decimals int) string {
+	if value == "" || decimals < 0 {
+		return value
+	}
+	f, _, err := big.ParseFloat(value, 10, 256, big.ToNearestEven)
+	if err != nil {
+		return value
+	}
+	return f.Text('f', decimals)
+}
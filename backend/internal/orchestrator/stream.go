@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	agentrpc "calc/backend/internal/proto/calc_agent"
+	orchest "calc/backend/internal/proto/orchest"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Как часто диспетчер раздаёт задачи подключённым агентам
+const dispatchInterval = 500 * time.Millisecond
+
+// Сколько сообщение ждёт места в очереди отправки, прежде чем сессия агента будет разорвана
+const sendTimeout = 5 * time.Second
+
+// session — открытый поток Connect одного агента
+type session struct {
+	agent    Agent
+	capacity int
+	send     chan *orchest.OrchestratorMessage
+	// Закрывается вместе с сессией; close разрывает сессию
+	done  <-chan struct{}
+	close func()
+
+	mu    sync.Mutex
+	tasks map[int]bool
+}
+
+// Подключённые агенты. Агент считается живым, пока открыт его поток.
+var connected = struct {
+	sync.Mutex
+	byAgent map[int]*session
+}{byAgent: make(map[int]*session)}
+
+// full сообщает, что агенту уже выдано столько задач, сколько у него вычислителей
+func (s *session) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tasks) >= s.capacity
+}
+
+func (s *session) assign(taskID int) {
+	s.mu.Lock()
+	s.tasks[taskID] = true
+	s.mu.Unlock()
+}
+
+// deliver ставит сообщение в очередь отправки агенту. Если агент не забирает сообщения
+// дольше sendTimeout, сессия разрывается: сообщение нельзя просто потерять, а после разрыва
+// задачи агента вернутся в очередь, и он их больше не вычисляет. Возвращает false,
+// если сообщение не отправлено.
+func (s *session) deliver(msg *orchest.OrchestratorMessage) bool {
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+	select {
+	case s.send <- msg:
+		return true
+	case <-s.done:
+		return false
+	case <-timer.C:
+		log.Printf("Agent %d does not accept messages for %s, closing its session", s.agent.ID, sendTimeout)
+		s.close()
+		return false
+	}
+}
+
+// release снимает задачу с агента и сообщает, была ли она на нём
+func (s *session) release(taskID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.tasks[taskID] {
+		return false
+	}
+	delete(s.tasks, taskID)
+	return true
+}
+
+func registerSession(sess *session) {
+	connected.Lock()
+	defer connected.Unlock()
+	connected.byAgent[sess.agent.ID] = sess
+}
+
+// unregisterSession убирает сессию и сразу возвращает задачи агента в очередь.
+// Если агент уже переподключился новой сессией, старая ничего не трогает.
+func unregisterSession(sess *session) {
+	connected.Lock()
+	current := connected.byAgent[sess.agent.ID] == sess
+	if current {
+		delete(connected.byAgent, sess.agent.ID)
+	}
+	connected.Unlock()
+	if !current {
+		return
+	}
+
+	if err := updateAgentStatus(strconv.Itoa(sess.agent.ID), "dead"); err != nil {
+		log.Printf("Error updating agent status: %v", err)
+	}
+	if err := releaseAgentTasks(sess.agent.ID); err != nil {
+		log.Printf("Error releasing tasks of agent %d: %v", sess.agent.ID, err)
+	}
+}
+
+func activeSessions() []*session {
+	connected.Lock()
+	defer connected.Unlock()
+	list := make([]*session, 0, len(connected.byAgent))
+	for _, sess := range connected.byAgent {
+		list = append(list, sess)
+	}
+	return list
+}
+
+// cancelTask просит агента прекратить вычисление задачи, если она ещё на нём
+func cancelTask(agentID, taskID int, reason string) {
+	connected.Lock()
+	sess := connected.byAgent[agentID]
+	connected.Unlock()
+	if sess == nil || !sess.release(taskID) {
+		return
+	}
+
+	msg := &orchest.OrchestratorMessage{
+		Payload: &orchest.OrchestratorMessage_Cancel{
+			Cancel: &orchest.Cancel{TaskId: int64(taskID), Reason: reason},
+		},
+	}
+	sess.deliver(msg)
+}
+
+// cancelTasks останавливает на агентах задачи: ID задачи → ID агента
+func cancelTasks(tasks map[int]int, reason string) {
+	for taskID, agentID := range tasks {
+		cancelTask(agentID, taskID, reason)
+	}
+}
+
+// othersConnected сообщает, подключён ли кроме agent ещё какой-нибудь агент его пула
+func othersConnected(agent Agent) bool {
+	connected.Lock()
+	defer connected.Unlock()
+	for id, sess := range connected.byAgent {
+		if id != agent.ID && samePool(sess.agent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// samePool сообщает, что агенты вычисляют одни и те же задачи: входят в одну организацию
+// или оба личные агенты одного пользователя
+func samePool(a, b Agent) bool {
+	if a.OrgID != 0 || b.OrgID != 0 {
+		return a.OrgID == b.OrgID
+	}
+	return a.User == b.User
+}
+
+// Реализация метода Connect: одна сессия на всё время жизни агента
+func (s orchestratorServer) Connect(stream orchest.Orchestrator_ConnectServer) error {
+	// Первым сообщением агент должен представиться
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := msg.GetHello()
+	if hello == nil {
+		return status.Error(codes.InvalidArgument, "первым сообщением агент должен прислать hello")
+	}
+
+	agent := contextAgent(stream.Context())
+	if err := checkAgentID(agent, hello.GetAgentId()); err != nil {
+		return err
+	}
+
+	// Пользователя могли исключить из организации или понизить в роли после регистрации агента
+	switch err := authorizePool(agent.User, agent.OrgID, RoleOperator); {
+	case err == errNotMember || err == errForbidden:
+		return status.Errorf(codes.PermissionDenied, "пользователь %s больше не может подключать агентов к организации", agent.User)
+	case err != nil:
+		log.Printf("Error checking access: %v", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	capacity := int(hello.GetCapacity())
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	sess := &session{
+		agent:    agent,
+		capacity: capacity,
+		send:     make(chan *orchest.OrchestratorMessage, capacity+16),
+		done:     ctx.Done(),
+		close:    cancel,
+		tasks:    make(map[int]bool),
+	}
+	registerSession(sess)
+	defer unregisterSession(sess)
+
+	if err := updateAgentStatus(strconv.Itoa(agent.ID), "alive"); err != nil {
+		log.Printf("Error updating agent status: %v", err)
+	}
+	if err := updateAgentLoad(agent.ID, capacity, 0); err != nil {
+		log.Printf("Error updating agent capacity: %v", err)
+	}
+	log.Printf("Агент %d пользователя %s подключился, вычислителей: %d", agent.ID, agent.User, capacity)
+
+	// Отправляем агенту сообщения из очереди сессии; если отправка не удалась, сессия разрывается
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-sess.send:
+				if err := stream.Send(m); err != nil {
+					log.Printf("Error sending message to agent %d: %v", agent.ID, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Принимаем сообщения агента, пока сессия не разорвана. Разорванная сессия завершает поток,
+	// после чего Recv тоже возвращает ошибку.
+	received := make(chan error, 1)
+	go func() {
+		received <- receiveMessages(stream, sess)
+	}()
+	select {
+	case err := <-received:
+		return err
+	case <-ctx.Done():
+		return status.Error(codes.Unavailable, "сессия агента разорвана")
+	}
+}
+
+// receiveMessages обрабатывает сообщения агента до закрытия потока
+func receiveMessages(stream orchest.Orchestrator_ConnectServer, sess *session) error {
+	agent, capacity := sess.agent, sess.capacity
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			log.Printf("Агент %d отключился", agent.ID)
+			return nil
+		}
+		if err != nil {
+			log.Printf("Поток агента %d прерван: %v", agent.ID, err)
+			return err
+		}
+
+		switch payload := msg.Payload.(type) {
+		case *orchest.AgentMessage_Heartbeat:
+			if err := updateAgentLoad(agent.ID, capacity, int(payload.Heartbeat.GetLoad())); err != nil {
+				log.Printf("Error updating agent heartbeat: %v", err)
+			}
+		case *orchest.AgentMessage_Progress:
+			if err := extendLease(int(payload.Progress.GetTaskId()), agent.ID); err != nil {
+				log.Printf("Error extending lease: %v", err)
+			}
+		case *orchest.AgentMessage_Result:
+			result := payload.Result
+			sess.release(int(result.GetTaskId()))
+			if err := handleTaskResult(agent.ID, result); err != nil {
+				log.Printf("Error handling result of task %d: %v", result.GetTaskId(), err)
+			}
+		}
+	}
+}
+
+// handleTaskResult сохраняет результат или ошибку задачи, присланные агентом
+func handleTaskResult(agentID int, result *orchest.TaskResult) error {
+	taskID := int(result.GetTaskId())
+	if result.GetError() != "" {
+		log.Printf("Agent %d failed task %d: %s", agentID, taskID, result.GetError())
+		return failTask(taskID, agentID, result.GetError())
+	}
+	return completeTask(taskID, agentID, result.GetResult().GetResult())
+}
+
+// taskMessage собирает сообщение с задачей для агента
+func taskMessage(task *Task) *orchest.Task {
+	return &orchest.Task{
+		Id: int64(task.ID),
+		Request: &agentrpc.ExpressionRequest{
+			Expression:  task.Expression(),
+			Id:          strconv.Itoa(task.ID),
+			Mode:        task.Mode,
+			Precision:   uint32(task.Precision),
+			Variables:   task.Variables,
+			Definitions: task.Definitions,
+			// Время каждой операции передаётся явно, поэтому нулевое время агент не заменит своим
+			Costs: int64Timings(task.Timings.Costs()),
+		},
+	}
+}
+
+func int64Timings(timings map[string]int) map[string]int64 {
+	result := make(map[string]int64, len(timings))
+	for name, ms := range timings {
+		result[name] = int64(ms)
+	}
+	return result
+}
+
+// runDispatcher раздаёт задачи из очереди подключённым агентам.
+// Каждому агенту одновременно выдаётся не больше задач, чем у него вычислителей.
+func runDispatcher() {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, sess := range activeSessions() {
+			for !sess.full() {
+				task, err := leaseTask(sess.agent)
+				if err == errNotMember || err == errForbidden {
+					// Задачи организации больше не для этого агента: разрываем сессию, его задачи вернутся в очередь
+					log.Printf("Агент %d пользователя %s отключён от пула организации %d: %v", sess.agent.ID, sess.agent.User, sess.agent.OrgID, err)
+					sess.close()
+					break
+				}
+				if err != nil {
+					log.Printf("Error leasing task: %v", err)
+					break
+				}
+				if task == nil {
+					break
+				}
+
+				sess.assign(task.ID)
+				msg := &orchest.OrchestratorMessage{
+					Payload: &orchest.OrchestratorMessage_Task{Task: taskMessage(task)},
+				}
+				if !sess.deliver(msg) {
+					if err := releaseTask(task.ID, sess.agent.ID); err != nil {
+						log.Printf("Error releasing task %d: %v", task.ID, err)
+					}
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Токены пользователей. Короткоживущий access токен — JWT, подписанный ключом сервера с kid в заголовке.
+// Refresh токен — случайная строка, в базе хранится только его хеш; при обновлении он заменяется новым,
+// а /logout отзывает его.
+
+// Сколько действует refresh токен
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+// Как часто сервер создаёт новый ключ подписи, если ключи не заданы через JWT_KEYS или JWT_SECRET.
+// Прежние ключи ещё keyRotationInterval проверяют выданные ими токены.
+var keyRotationInterval = 24 * time.Hour
+
+// Сколько после обновления refresh токена его повторное предъявление ещё не считается кражей:
+// две вкладки браузера могут обновить токен из одной куки одновременно
+const refreshGracePeriod = 30 * time.Second
+
+// Выставлять ли кукам флаг Secure, задаётся COOKIE_SECURE. По умолчанию включён; выключать его
+// (COOKIE_SECURE=false) стоит только для разработки, когда страницы открываются по http без HTTPS прокси.
+var cookieSecure = true
+
+var errInvalidRefreshToken = errors.New("невалидный refresh токен")
+
+// signingKeys — ключи подписи access токенов по kid. Новые токены подписываются ключом current.
+var signingKeys = struct {
+	sync.RWMutex
+	current string
+	keys    map[string][]byte
+	// Ключи заданы переменными окружения и не ротируются
+	static bool
+}{keys: make(map[string][]byte)}
+
+// loadAuthConfig читает COOKIE_SECURE и JWT_KEY_ROTATION
+func loadAuthConfig() error {
+	if value := os.Getenv("COOKIE_SECURE"); value != "" {
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("COOKIE_SECURE должно быть true или false, получено %q", value)
+		}
+		cookieSecure = secure
+	}
+	if value := os.Getenv("JWT_KEY_ROTATION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= tokenLifetime {
+			return fmt.Errorf("JWT_KEY_ROTATION должно быть длительностью больше %v, получено %q", tokenLifetime, value)
+		}
+		keyRotationInterval = d
+	}
+	return nil
+}
+
+// createTokenTables создаёт таблицы ключей подписи и refresh токенов
+func createTokenTables() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS signing_keys (
+		kid TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Когда токен заменили новым при обновлении, в отличие от отзыва при выходе
+	return addColumn("refresh_tokens", "rotated_at", "TIMESTAMP")
+}
+
+// loadSigningKeys загружает ключи подписи. JWT_KEYS задаёт набор ключей как "kid1=секрет1,kid2=секрет2"
+// (первым подписываются новые токены, остальные только проверяются), JWT_SECRET — один ключ.
+// Без них ключи создаются сервером, хранятся в базе и ротируются раз в keyRotationInterval.
+func loadSigningKeys() error {
+	if value := os.Getenv("JWT_KEYS"); value != "" {
+		return setStaticKeys(value)
+	}
+	if value := os.Getenv("JWT_SECRET"); value != "" {
+		return setStaticKeys("default=" + value)
+	}
+	return rotateSigningKeys()
+}
+
+func setStaticKeys(value string) error {
+	keys := make(map[string][]byte)
+	current := ""
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("ключ подписи нужно указать как kid=секрет, получено %q", pair)
+		}
+		kid, secret := strings.TrimSpace(pair[:i]), pair[i+1:]
+		if len(secret) < 32 {
+			return fmt.Errorf("секрет ключа подписи %s должен быть не короче 32 байт", kid)
+		}
+		if current == "" {
+			current = kid
+		}
+		keys[kid] = []byte(secret)
+	}
+
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	signingKeys.current, signingKeys.keys, signingKeys.static = current, keys, true
+	return nil
+}
+
+// rotateSigningKeys создаёт новый ключ, если последний старше keyRotationInterval,
+// удаляет ключи, которыми уже не может быть подписан ни один действующий токен, и загружает остальные
+func rotateSigningKeys() error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	now := time.Now()
+	var newest time.Time
+	err = tx.QueryRow("SELECT created_at FROM signing_keys ORDER BY created_at DESC LIMIT 1").Scan(&newest)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || now.Sub(newest) >= keyRotationInterval {
+		kid, err := randomToken(8)
+		if err != nil {
+			return err
+		}
+		secret, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO signing_keys (kid, secret, created_at) VALUES (?, ?, ?)", kid, secret, now); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM signing_keys WHERE created_at < ?", now.Add(-2*keyRotationInterval))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT kid, secret FROM signing_keys ORDER BY created_at")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	keys := make(map[string][]byte)
+	current := ""
+	for rows.Next() {
+		var kid, secret string
+		if err := rows.Scan(&kid, &secret); err != nil {
+			return err
+		}
+		keys[kid] = []byte(secret)
+		current = kid
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	signingKeys.current, signingKeys.keys = current, keys
+	return nil
+}
+
+// runKeyRotation периодически ротирует ключи подписи, созданные сервером
+func runKeyRotation() {
+	signingKeys.RLock()
+	static := signingKeys.static
+	signingKeys.RUnlock()
+	if static {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := rotateSigningKeys(); err != nil {
+			log.Printf("Error rotating signing keys: %v", err)
+		}
+	}
+}
+
+// randomToken возвращает n случайных байт в виде hex строки
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signingKey возвращает секрет ключа подписи по kid
+func signingKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	signingKeys.RLock()
+	defer signingKeys.RUnlock()
+	secret, ok := signingKeys.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("неизвестный ключ подписи %q", kid)
+	}
+	return secret, nil
+}
+
+// issueRefreshToken выдаёт пользователю refresh токен
+func issueRefreshToken(user string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("INSERT INTO refresh_tokens (token_hash, user, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), user, time.Now().Add(refreshTokenLifetime))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useRefreshToken отзывает refresh токен и возвращает его пользователя.
+// Повторное предъявление отозванного токена значит, что его украли: тогда отзываются все токены пользователя.
+// Исключение — токен, заменённый новым не больше refreshGracePeriod назад: его ещё принимают.
+func useRefreshToken(token string) (string, error) {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return "", err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	var user string
+	var expiresAt time.Time
+	var revoked bool
+	var rotatedAt sql.NullTime
+	err = tx.QueryRow("SELECT user, expires_at, revoked, rotated_at FROM refresh_tokens WHERE token_hash = ?", hashToken(token)).
+		Scan(&user, &expiresAt, &revoked, &rotatedAt)
+	if err == sql.ErrNoRows {
+		return "", errInvalidRefreshToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if revoked && rotatedAt.Valid && now.Sub(rotatedAt.Time) <= refreshGracePeriod {
+		revoked = false
+	} else if revoked {
+		_, err = tx.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE user = ?", user)
+	} else {
+		_, err = tx.Exec("UPDATE refresh_tokens SET revoked = 1, rotated_at = ? WHERE token_hash = ?", now, hashToken(token))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return "", err
+	}
+	if revoked || now.After(expiresAt) {
+		return "", errInvalidRefreshToken
+	}
+	return user, nil
+}
+
+// revokeRefreshToken отзывает refresh токен, неизвестный токен игнорируется
+func revokeRefreshToken(token string) error {
+	_, err := db.Exec("UPDATE refresh_tokens SET revoked = 1 WHERE token_hash = ?", hashToken(token))
+	return err
+}
+
+// issueSession выдаёт пользователю access и refresh токены и кладёт их в куки
+func issueSession(w http.ResponseWriter, user string) (tokenResponse, error) {
+	access, err := issueToken(user)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refresh, err := issueRefreshToken(user)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	setTokenCookie(w, access)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refresh,
+		Path:     "/",
+		MaxAge:   int(refreshTokenLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return tokenResponse{Token: access, RefreshToken: refresh}, nil
+}
+
+// clearSession удаляет куки с токенами
+func clearSession(w http.ResponseWriter) {
+	for _, name := range []string{"token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   cookieSecure,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// requestRefreshToken возвращает refresh токен из тела {"refresh_token": "..."} или из куки
+func requestRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return "", false
+	}
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie("refresh_token"); err == nil {
+			req.RefreshToken = cookie.Value
+		}
+	}
+	return req.RefreshToken, true
+}
+
+// POST /api/v1/auth/refresh — новая пара токенов в обмен на refresh токен, прежний отзывается
+func apiRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	refresh, ok := requestRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	if refresh == "" {
+		writeError(w, http.StatusUnauthorized, "требуется refresh токен")
+		return
+	}
+	user, err := useRefreshToken(refresh)
+	if err == errInvalidRefreshToken {
+		clearSession(w)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error using refresh token: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+
+	resp, err := issueSession(w, user)
+	if err != nil {
+		log.Printf("Error issuing token: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/v1/auth/logout — отзывает refresh токен и удаляет куки
+func apiLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	refresh, ok := requestRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	if err := revokeRefreshToken(refresh); err != nil {
+		log.Printf("Error revoking refresh token: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	clearSession(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /logout — выход со страниц сайта, после него открывается страница входа
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		if err := revokeRefreshToken(cookie.Value); err != nil {
+			log.Printf("Error revoking refresh token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSession(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"calc/backend/internal/expr"
+)
+
+// node — узел дерева выражения. У листа заполнено только value (число, константа или переменная),
+// у операции — op и оба потомка, у функции и отрицания ! — имя в op, первый аргумент в left
+// и второй, если он есть, в right. Узел с op == subtreeOperation вычисляется одним агентом
+// целиком, его текст хранится в value.
+type node struct {
+	op    string
+	value string
+	left  *node
+	right *node
+}
+
+// Условный оператор и логические && и || не вычисляют лишний операнд, например в x != 0 ? 1/x : 0.
+// Поэтому такие поддеревья не разбиваются на задачи, а целиком отправляются одному агенту.
+const subtreeOperation = "expression"
+
+func (n *node) isLeaf() bool {
+	return n.op == ""
+}
+
+// parseTree разбирает выражение парсером пакета expr, проверяет числа для режима numeric
+// и переводит AST в дерево задач. Ошибки разбора возвращаются как *expr.SyntaxError.
+// У присваивания x = 3*4 в дерево попадает только правая часть.
+func parseTree(expression string, numeric expr.Numeric) (*node, error) {
+	tree, err := expr.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	return buildTree(tree, numeric)
+}
+
+// buildTree проверяет числа AST для режима numeric и переводит его в дерево задач
+func buildTree(tree expr.Node, numeric expr.Numeric) (*node, error) {
+	if err := numeric.Validate(tree); err != nil {
+		return nil, err
+	}
+	return toNode(tree)
+}
+
+// preparedExpression — выражение пользователя, готовое к вычислению
+type preparedExpression struct {
+	tree *node
+	// Имя переменной, если выражение ей присваивается
+	variable string
+	// Значения переменных и тексты функций пользователя, от которых зависит выражение
+	bindings    map[string]string
+	definitions map[string]string
+}
+
+// prepareExpression разбирает выражение пользователя, проверяет вызовы его функций,
+// находит значения переменных и строит дерево задач
+func prepareExpression(expression, user string, numeric expr.Numeric) (*preparedExpression, error) {
+	ast, err := expr.Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ast.(*expr.Definition); ok {
+		return nil, &expr.SyntaxError{Pos: ast.Position(), Message: "определение функции нельзя вычислить"}
+	}
+	funcs, texts, err := loadFunctions(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := numeric.ValidateWith(ast, funcs); err != nil {
+		return nil, err
+	}
+	tree, err := toNode(ast)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := bindVariables(user, ast, numeric)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedExpression{
+		tree:        tree,
+		variable:    assignedVariable(ast),
+		bindings:    bindings,
+		definitions: usedDefinitions(ast, funcs, texts),
+	}, nil
+}
+
+// newNumeric проверяет режим вычислений и точность из запроса
+func newNumeric(mode string, precision int) (expr.Numeric, error) {
+	if precision < 0 {
+		return expr.Numeric{}, fmt.Errorf("точность не может быть отрицательной")
+	}
+	return expr.NewNumeric(mode, uint(precision))
+}
+
+func toNode(n expr.Node) (*node, error) {
+	switch n := n.(type) {
+	case *expr.NumberLit:
+		return &node{value: n.Value}, nil
+	case *expr.Ident:
+		return &node{value: n.Name}, nil
+	case *expr.Assign:
+		return toNode(n.Value)
+	case *expr.Call:
+		// Функция пользователя вычисляется одним агентом вместе с аргументами
+		if !expr.IsFunction(n.Name) {
+			return &node{op: subtreeOperation, value: n.String()}, nil
+		}
+		args := make([]*node, len(n.Args))
+		for i, arg := range n.Args {
+			a, err := toNode(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = a
+		}
+		// min и max от нескольких аргументов считаются попарно: max(a, b, c) = max(max(a, b), c)
+		if len(args) == 1 && (n.Name == "min" || n.Name == "max") {
+			return args[0], nil
+		}
+		result := &node{op: n.Name, left: args[0]}
+		for i, arg := range args[1:] {
+			if i > 0 {
+				result = &node{op: n.Name, left: result}
+			}
+			result.right = arg
+		}
+		return result, nil
+	case *expr.Ternary:
+		return &node{op: subtreeOperation, value: n.String()}, nil
+	case *expr.Unary:
+		operand, err := toNode(n.Operand)
+		if err != nil || n.Op == "+" {
+			return operand, err
+		}
+		if n.Op == "!" {
+			return &node{op: n.Op, left: operand}, nil
+		}
+		// Минус перед числом — просто знак числа
+		if operand.isLeaf() {
+			return &node{value: negate(operand.value)}, nil
+		}
+		// Двойной минус сокращается: -(0-x) = x
+		if operand.op == "-" && operand.left.isLeaf() && operand.left.value == "0" {
+			return operand.right, nil
+		}
+		// Минус перед операцией вычисляется как вычитание из нуля
+		return &node{op: "-", left: &node{value: "0"}, right: operand}, nil
+	case *expr.Binary:
+		if n.Op == "&&" || n.Op == "||" {
+			return &node{op: subtreeOperation, value: n.String()}, nil
+		}
+		left, err := toNode(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := toNode(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &node{op: n.Op, left: left, right: right}, nil
+	}
+	return nil, fmt.Errorf("неподдерживаемый узел выражения %T", n)
+}
+
+// negate меняет знак числа, записанного строкой
+func negate(value string) string {
+	if strings.HasPrefix(value, "-") {
+		return value[1:]
+	}
+	return "-" + value
+}
+
+// nodeTask — одна независимая бинарная операция, которую можно отправить агенту.
+// Отрицательные операнды и дроби режима rat берутся в скобки,
+// чтобы -2^2 не превратилось в -(2^2), а 1/2+1/3 — в ((1/2)+1)/3.
+func nodeTask(op, left, right string) string {
+	switch {
+	case op == subtreeOperation:
+		return left
+	case op == "!":
+		return op + operand(left)
+	case expr.IsFunction(op):
+		if right == "" {
+			return op + "(" + left + ")"
+		}
+		return op + "(" + left + "," + right + ")"
+	}
+	return operand(left) + op + operand(right)
+}
+
+func operand(value string) string {
+	if strings.HasPrefix(value, "-") || strings.Contains(value, "/") {
+		return "(" + value + ")"
+	}
+	return value
+}
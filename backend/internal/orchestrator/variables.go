@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"calc/backend/internal/expr"
+)
+
+// Variable — переменная пользователя. Её значение — результат выражения ExpressionID вида x = 3*4.
+// Пока новое выражение переменной вычисляется, у неё остаётся прежнее значение.
+type Variable struct {
+	Name         string `json:"name"`
+	Value        string `json:"value,omitempty"`
+	ExpressionID int    `json:"expression_id"`
+	Status       string `json:"status"`
+}
+
+var errVariableInUse = errors.New("от переменной зависят другие переменные")
+
+// createVariablesTable создаёт таблицу переменных и колонки выражений, которые к ним относятся
+func createVariablesTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS variables (
+		user TEXT NOT NULL,
+		name TEXT NOT NULL,
+		expression_id INTEGER NOT NULL,
+		value TEXT,
+		PRIMARY KEY (user, name)
+	);`)
+	if err != nil {
+		return err
+	}
+
+	// Имя переменной, которой присваивается выражение, и значения переменных,
+	// с которыми оно вычисляется, в виде JSON объекта {"x": "12"}
+	if err := addColumn("expressions", "variable", "TEXT"); err != nil {
+		return err
+	}
+	return addColumn("expressions", "bindings", "TEXT")
+}
+
+// assignedVariable возвращает имя переменной, которой присваивается выражение, или пустую строку
+func assignedVariable(tree expr.Node) string {
+	if assign, ok := tree.(*expr.Assign); ok {
+		return assign.Name
+	}
+	return ""
+}
+
+// bindVariables находит значения всех переменных выражения и проверяет, что они допустимы в режиме numeric.
+// Неизвестная или ещё не вычисленная переменная — ошибка *expr.SyntaxError с её позицией.
+// Присваивание не может зависеть от самой переменной, даже через другие переменные.
+func bindVariables(user string, tree expr.Node, numeric expr.Numeric) (map[string]string, error) {
+	bindings := make(map[string]string)
+	var err error
+	expr.Inspect(tree, func(n expr.Node) bool {
+		ident, ok := n.(*expr.Ident)
+		if !ok || expr.IsConstant(ident.Name) {
+			return true
+		}
+		if _, ok := bindings[ident.Name]; ok {
+			return true
+		}
+
+		var value sql.NullString
+		e := db.QueryRow("SELECT value FROM variables WHERE user = ? AND name = ?", user, ident.Name).Scan(&value)
+		switch {
+		case e == sql.ErrNoRows:
+			err = &expr.SyntaxError{Pos: ident.Pos, Message: fmt.Sprintf("неизвестная переменная %q", ident.Name)}
+		case e != nil:
+			err = e
+		case !value.Valid:
+			err = &expr.SyntaxError{Pos: ident.Pos, Message: fmt.Sprintf("переменная %s ещё не вычислена", ident.Name)}
+		default:
+			bindings[ident.Name] = value.String
+			if _, e := numeric.EvalWith(ident, expr.Env{Vars: bindings}); e != nil {
+				err = &expr.SyntaxError{Pos: ident.Pos, Message: e.Error()}
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if name := assignedVariable(tree); name != "" {
+		if err := checkCycle(user, name, bindings); err != nil {
+			return nil, &expr.SyntaxError{Pos: tree.Position(), Message: err.Error()}
+		}
+	}
+	return bindings, nil
+}
+
+// checkCycle проверяет, что переменные из bindings не зависят от name
+func checkCycle(user, name string, bindings map[string]string) error {
+	seen := make(map[string]bool)
+	queue := make([]string, 0, len(bindings))
+	for dependency := range bindings {
+		queue = append(queue, dependency)
+	}
+	sort.Strings(queue)
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == name {
+			return fmt.Errorf("переменная %s зависит сама от себя", name)
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+
+		var data string
+		err := db.QueryRow(`SELECT COALESCE(e.bindings, '') FROM variables v JOIN expressions e ON e.id = v.expression_id
+			WHERE v.user = ? AND v.name = ?`, user, current).Scan(&data)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dependencies, err := decodeBindings(data)
+		if err != nil {
+			return err
+		}
+		for dependency := range dependencies {
+			queue = append(queue, dependency)
+		}
+	}
+	return nil
+}
+
+// bindingsJSON записывает значения переменных JSON объектом, пустые значения — NULL
+func bindingsJSON(bindings map[string]string) (sql.NullString, error) {
+	if len(bindings) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(bindings)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func decodeBindings(data string) (map[string]string, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var bindings map[string]string
+	if err := json.Unmarshal([]byte(data), &bindings); err != nil {
+		return nil, fmt.Errorf("error decoding variables: %v", err)
+	}
+	return bindings, nil
+}
+
+// storeVariable записывает результат выражения в переменную, если это её текущее выражение.
+// Возвращает пользователя и имя переменной, если её значение изменилось.
+func storeVariable(tx *sql.Tx, expressionID int, result string) (string, string, error) {
+	var user, name string
+	var value sql.NullString
+	err := tx.QueryRow("SELECT user, name, value FROM variables WHERE expression_id = ?", expressionID).Scan(&user, &name, &value)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if value.Valid && value.String == result {
+		return "", "", nil
+	}
+
+	_, err = tx.Exec("UPDATE variables SET value = ? WHERE user = ? AND name = ?", result, user, name)
+	if err != nil {
+		return "", "", err
+	}
+	return user, name, nil
+}
+
+// reevaluateDependents заново вычисляет выражения пользователя, которые зависят от переменной
+// (column = "bindings") или функции (column = "definitions") name.
+// Старые присваивания, которые уже заменены новыми, не пересчитываются.
+func reevaluateDependents(user, column, name string) {
+	key, _ := json.Marshal(name)
+	rows, err := db.Query(`SELECT id FROM expressions
+		WHERE user = ? AND instr(`+column+`, ?) > 0 AND status != 'cancelled'
+		AND (variable IS NULL OR id IN (SELECT expression_id FROM variables WHERE user = ?))
+		ORDER BY id`, user, string(key)+":", user)
+	if err != nil {
+		log.Printf("Error selecting dependents of %s: %v", name, err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning dependent expression: %v", err)
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := reevaluateExpression(id); err != nil {
+			log.Printf("Error re-evaluating expression %d: %v", id, err)
+		}
+	}
+}
+
+// reevaluateExpression вычисляет выражение заново с текущими значениями переменных.
+// Задачи прежнего вычисления отменяются.
+func reevaluateExpression(expressionID int) error {
+	var expression, user, mode string
+	var precision int
+	var timeoutMS sql.NullInt64
+	err := db.QueryRow("SELECT expression, user, mode, precision, timeout_ms FROM expressions WHERE id = ?", expressionID).
+		Scan(&expression, &user, &mode, &precision, &timeoutMS)
+	if err != nil {
+		return err
+	}
+	timeout := expressionTimeout
+	if timeoutMS.Valid {
+		timeout = time.Duration(timeoutMS.Int64) * time.Millisecond
+	}
+
+	// Переменную или функцию могли удалить, тогда выражение завершается с ошибкой
+	var tree *node
+	var values, texts map[string]string
+	numeric, err := newNumeric(mode, precision)
+	if err == nil {
+		var prepared *preparedExpression
+		prepared, err = prepareExpression(expression, user, numeric)
+		if err == nil {
+			tree, values, texts = prepared.tree, prepared.bindings, prepared.definitions
+		}
+	}
+	bindings, jsonErr := bindingsJSON(values)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	definitions, jsonErr := bindingsJSON(texts)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	// Начинаем транзакцию
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		log.Printf("Error beginning transaction: %v", txErr)
+		return txErr
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	leased, txErr := leasedTasks(tx, "SELECT id, agent_id FROM tasks WHERE expression_id = ? AND status = 'leased'", expressionID)
+	if txErr != nil {
+		return txErr
+	}
+	_, txErr = tx.Exec("UPDATE tasks SET status = 'cancelled' WHERE expression_id = ? AND status != 'done'", expressionID)
+	if txErr != nil {
+		return txErr
+	}
+
+	if err != nil {
+		_, txErr = tx.Exec("UPDATE expressions SET status = 'error', error = ?, result_text = NULL WHERE id = ?", err.Error(), expressionID)
+	} else {
+		var deadline sql.NullTime
+		if timeout > 0 {
+			deadline = sql.NullTime{Time: time.Now().Add(timeout), Valid: true}
+		}
+		_, txErr = tx.Exec("UPDATE expressions SET status = 'pending', error = NULL, result_text = NULL, bindings = ?, definitions = ?, deadline = ? WHERE id = ?",
+			bindings, definitions, deadline, expressionID)
+	}
+	if txErr != nil {
+		return txErr
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+
+	cancelTasks(leased, "значение переменной изменилось")
+	if err != nil {
+		return nil
+	}
+	return enqueueExpression(expressionID, tree, numeric, values)
+}
+
+func getVariables(user string) ([]Variable, error) {
+	rows, err := db.Query(`SELECT v.name, COALESCE(v.value, ''), v.expression_id, COALESCE(e.status, '')
+		FROM variables v LEFT JOIN expressions e ON e.id = v.expression_id
+		WHERE v.user = ? ORDER BY v.name`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Variable{}
+	for rows.Next() {
+		var v Variable
+		if err := rows.Scan(&v.Name, &v.Value, &v.ExpressionID, &v.Status); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// deleteVariable удаляет переменную, если от неё не зависят текущие выражения других переменных
+func deleteVariable(user, name string) error {
+	// Начинаем транзакцию
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error beginning transaction: %v", err)
+		return err
+	}
+	defer tx.Rollback() // Откатываем транзакцию в случае возникновения ошибки
+
+	key, _ := json.Marshal(name)
+	var dependents int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM variables v JOIN expressions e ON e.id = v.expression_id
+		WHERE v.user = ? AND instr(e.bindings, ?) > 0`, user, string(key)+":").Scan(&dependents)
+	if err != nil {
+		return err
+	}
+	if dependents > 0 {
+		return errVariableInUse
+	}
+
+	res, err := tx.Exec("DELETE FROM variables WHERE user = ? AND name = ?", user, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Заканчиваем транзакцию, фиксируя изменения
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GET /api/v1/variables
+func apiVariablesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := getVariables(user)
+	if err != nil {
+		log.Printf("Error getting variables: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET и DELETE /api/v1/variables/{name}. Значение переменной задаётся выражением x = 3*4.
+func apiVariableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+
+	user, ok := apiUser(w, r)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/variables/")
+	if r.Method == http.MethodDelete {
+		err := deleteVariable(user, name)
+		switch {
+		case err == sql.ErrNoRows:
+			writeError(w, http.StatusNotFound, "переменная не найдена")
+		case err == errVariableInUse:
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			log.Printf("Error deleting variable: %v", err)
+			writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	list, err := getVariables(user)
+	if err != nil {
+		log.Printf("Error getting variables: %v", err)
+		writeError(w, http.StatusInternalServerError, "внутренняя ошибка сервера")
+		return
+	}
+	for _, v := range list {
+		if v.Name == name {
+			writeJSON(w, http.StatusOK, v)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "переменная не найдена")
+}
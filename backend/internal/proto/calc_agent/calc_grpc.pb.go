@@ -1,109 +0,0 @@
-// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
-// versions:
-// - protoc-gen-go-grpc v1.3.0
-// - protoc             v5.27.0--rc1
-// source: backend/internal/proto/calc_agent/calc.proto
-
-package calc_agent
-
-import (
-	context "context"
-	grpc "google.golang.org/grpc"
-	codes "google.golang.org/grpc/codes"
-	status "google.golang.org/grpc/status"
-)
-
-// This is a compile-time assertion to ensure that this generated file
-// is compatible with the grpc package it is being compiled against.
-// Requires gRPC-Go v1.32.0 or later.
-const _ = grpc.SupportPackageIsVersion7
-
-const (
-	Agent_CalculateExpression_FullMethodName = "/agentrpc.Agent/CalculateExpression"
-)
-
-// AgentClient is the client API for Agent service.
-//
-// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
-type AgentClient interface {
-	CalculateExpression(ctx context.Context, in *ExpressionRequest, opts ...grpc.CallOption) (*Result, error)
-}
-
-type agentClient struct {
-	cc grpc.ClientConnInterface
-}
-
-func NewAgentClient(cc grpc.ClientConnInterface) AgentClient {
-	return &agentClient{cc}
-}
-
-func (c *agentClient) CalculateExpression(ctx context.Context, in *ExpressionRequest, opts ...grpc.CallOption) (*Result, error) {
-	out := new(Result)
-	err := c.cc.Invoke(ctx, Agent_CalculateExpression_FullMethodName, in, out, opts...)
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
-}
-
-// AgentServer is the server API for Agent service.
-// All implementations must embed UnimplementedAgentServer
-// for forward compatibility
-type AgentServer interface {
-	CalculateExpression(context.Context, *ExpressionRequest) (*Result, error)
-	mustEmbedUnimplementedAgentServer()
-}
-
-// UnimplementedAgentServer must be embedded to have forward compatible implementations.
-type UnimplementedAgentServer struct {
-}
-
-func (UnimplementedAgentServer) CalculateExpression(context.Context, *ExpressionRequest) (*Result, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method CalculateExpression not implemented")
-}
-func (UnimplementedAgentServer) mustEmbedUnimplementedAgentServer() {}
-
-// UnsafeAgentServer may be embedded to opt out of forward compatibility for this service.
-// Use of this interface is not recommended, as added methods to AgentServer will
-// result in compilation errors.
-type UnsafeAgentServer interface {
-	mustEmbedUnimplementedAgentServer()
-}
-
-func RegisterAgentServer(s grpc.ServiceRegistrar, srv AgentServer) {
-	s.RegisterService(&Agent_ServiceDesc, srv)
-}
-
-func _Agent_CalculateExpression_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(ExpressionRequest)
-	if err := dec(in); err != nil {
-		return nil, err
-	}
-	if interceptor == nil {
-		return srv.(AgentServer).CalculateExpression(ctx, in)
-	}
-	info := &grpc.UnaryServerInfo{
-		Server:     srv,
-		FullMethod: Agent_CalculateExpression_FullMethodName,
-	}
-	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(AgentServer).CalculateExpression(ctx, req.(*ExpressionRequest))
-	}
-	return interceptor(ctx, in, info, handler)
-}
-
-// Agent_ServiceDesc is the grpc.ServiceDesc for Agent service.
-// It's only intended for direct use with grpc.RegisterService,
-// and not to be introspected or modified (even as a copy)
-var Agent_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "agentrpc.Agent",
-	HandlerType: (*AgentServer)(nil),
-	Methods: []grpc.MethodDesc{
-		{
-			MethodName: "CalculateExpression",
-			Handler:    _Agent_CalculateExpression_Handler,
-		},
-	},
-	Streams:  []grpc.StreamDesc{},
-	Metadata: "backend/internal/proto/calc_agent/calc.proto",
-}
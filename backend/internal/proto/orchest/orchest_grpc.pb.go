@@ -19,14 +19,27 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	Orchestrator_Ping_FullMethodName = "/orchest.Orchestrator/Ping"
+	Orchestrator_Register_FullMethodName     = "/orchest.Orchestrator/Register"
+	Orchestrator_Ping_FullMethodName         = "/orchest.Orchestrator/Ping"
+	Orchestrator_GetTask_FullMethodName      = "/orchest.Orchestrator/GetTask"
+	Orchestrator_SubmitResult_FullMethodName = "/orchest.Orchestrator/SubmitResult"
+	Orchestrator_Connect_FullMethodName      = "/orchest.Orchestrator/Connect"
 )
 
 // OrchestratorClient is the client API for Orchestrator service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type OrchestratorClient interface {
+	// Агент получает у оркестратора свой ID и токен, таблица agents принадлежит только оркестратору.
+	// Register требует access токен пользователя, остальные методы — метаданные agent-id
+	// и authorization: Bearer <токен агента>.
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
 	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
+	// Агент сам забирает задачу из очереди, оркестратору не нужен его адрес
+	GetTask(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*Task, error)
+	SubmitResult(ctx context.Context, in *TaskResult, opts ...grpc.CallOption) (*Ack, error)
+	// Долгоживущая сессия агента: пульс, задачи, прогресс, результаты и отмены
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Orchestrator_ConnectClient, error)
 }
 
 type orchestratorClient struct {
@@ -37,6 +50,15 @@ func NewOrchestratorClient(cc grpc.ClientConnInterface) OrchestratorClient {
 	return &orchestratorClient{cc}
 }
 
+func (c *orchestratorClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	err := c.cc.Invoke(ctx, Orchestrator_Register_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *orchestratorClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error) {
 	out := new(PingResponse)
 	err := c.cc.Invoke(ctx, Orchestrator_Ping_FullMethodName, in, out, opts...)
@@ -46,11 +68,69 @@ func (c *orchestratorClient) Ping(ctx context.Context, in *PingRequest, opts ...
 	return out, nil
 }
 
+func (c *orchestratorClient) GetTask(ctx context.Context, in *AgentInfo, opts ...grpc.CallOption) (*Task, error) {
+	out := new(Task)
+	err := c.cc.Invoke(ctx, Orchestrator_GetTask_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orchestratorClient) SubmitResult(ctx context.Context, in *TaskResult, opts ...grpc.CallOption) (*Ack, error) {
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, Orchestrator_SubmitResult_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orchestratorClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Orchestrator_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Orchestrator_ServiceDesc.Streams[0], Orchestrator_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orchestratorConnectClient{stream}
+	return x, nil
+}
+
+type Orchestrator_ConnectClient interface {
+	Send(*AgentMessage) error
+	Recv() (*OrchestratorMessage, error)
+	grpc.ClientStream
+}
+
+type orchestratorConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *orchestratorConnectClient) Send(m *AgentMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *orchestratorConnectClient) Recv() (*OrchestratorMessage, error) {
+	m := new(OrchestratorMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // OrchestratorServer is the server API for Orchestrator service.
 // All implementations must embed UnimplementedOrchestratorServer
 // for forward compatibility
 type OrchestratorServer interface {
+	// Агент получает у оркестратора свой ID и токен, таблица agents принадлежит только оркестратору.
+	// Register требует access токен пользователя, остальные методы — метаданные agent-id
+	// и authorization: Bearer <токен агента>.
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
 	Ping(context.Context, *PingRequest) (*PingResponse, error)
+	// Агент сам забирает задачу из очереди, оркестратору не нужен его адрес
+	GetTask(context.Context, *AgentInfo) (*Task, error)
+	SubmitResult(context.Context, *TaskResult) (*Ack, error)
+	// Долгоживущая сессия агента: пульс, задачи, прогресс, результаты и отмены
+	Connect(Orchestrator_ConnectServer) error
 	mustEmbedUnimplementedOrchestratorServer()
 }
 
@@ -58,9 +138,21 @@ type OrchestratorServer interface {
 type UnimplementedOrchestratorServer struct {
 }
 
+func (UnimplementedOrchestratorServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
+}
 func (UnimplementedOrchestratorServer) Ping(context.Context, *PingRequest) (*PingResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
 }
+func (UnimplementedOrchestratorServer) GetTask(context.Context, *AgentInfo) (*Task, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTask not implemented")
+}
+func (UnimplementedOrchestratorServer) SubmitResult(context.Context, *TaskResult) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitResult not implemented")
+}
+func (UnimplementedOrchestratorServer) Connect(Orchestrator_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
 func (UnimplementedOrchestratorServer) mustEmbedUnimplementedOrchestratorServer() {}
 
 // UnsafeOrchestratorServer may be embedded to opt out of forward compatibility for this service.
@@ -74,6 +166,24 @@ func RegisterOrchestratorServer(s grpc.ServiceRegistrar, srv OrchestratorServer)
 	s.RegisterService(&Orchestrator_ServiceDesc, srv)
 }
 
+func _Orchestrator_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrchestratorServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Orchestrator_Register_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrchestratorServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Orchestrator_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PingRequest)
 	if err := dec(in); err != nil {
@@ -92,6 +202,68 @@ func _Orchestrator_Ping_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Orchestrator_GetTask_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AgentInfo)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrchestratorServer).GetTask(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Orchestrator_GetTask_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrchestratorServer).GetTask(ctx, req.(*AgentInfo))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Orchestrator_SubmitResult_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TaskResult)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrchestratorServer).SubmitResult(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Orchestrator_SubmitResult_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrchestratorServer).SubmitResult(ctx, req.(*TaskResult))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Orchestrator_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(OrchestratorServer).Connect(&orchestratorConnectServer{stream})
+}
+
+type Orchestrator_ConnectServer interface {
+	Send(*OrchestratorMessage) error
+	Recv() (*AgentMessage, error)
+	grpc.ServerStream
+}
+
+type orchestratorConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *orchestratorConnectServer) Send(m *OrchestratorMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *orchestratorConnectServer) Recv() (*AgentMessage, error) {
+	m := new(AgentMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Orchestrator_ServiceDesc is the grpc.ServiceDesc for Orchestrator service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,11 +271,30 @@ var Orchestrator_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "orchest.Orchestrator",
 	HandlerType: (*OrchestratorServer)(nil),
 	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Orchestrator_Register_Handler,
+		},
 		{
 			MethodName: "Ping",
 			Handler:    _Orchestrator_Ping_Handler,
 		},
+		{
+			MethodName: "GetTask",
+			Handler:    _Orchestrator_GetTask_Handler,
+		},
+		{
+			MethodName: "SubmitResult",
+			Handler:    _Orchestrator_SubmitResult_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Orchestrator_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "backend/internal/proto/orchest/orchest.proto",
 }